@@ -7,4 +7,5 @@ require (
 	github.com/jinzhu/gorm v1.9.14
 	github.com/joho/godotenv v1.3.0
 	github.com/naspinall/Hive v0.0.0-20200622121928-749c425d86f4
+	golang.org/x/crypto v0.11.0
 )
@@ -7,9 +7,12 @@ import (
 )
 
 // Will need to refine.
-func SubAck(pi uint16, rc byte, w io.Writer) error {
-	sa := packets.SubAck(pi, rc)
+func SubAck(pi uint16, rcs []byte, w io.Writer) error {
+	sa := packets.SubAck(pi, rcs)
 	b, err := sa.Encode()
+	if err != nil {
+		return err
+	}
 	_, err = w.Write(b)
 	if err != nil {
 		return err
@@ -0,0 +1,17 @@
+package client
+
+import (
+	"io"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+func UnsubAck(pi uint16, rcs []byte, w io.Writer) error {
+	ua := packets.UnsubAck(pi, rcs)
+	b, err := ua.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Message is a QoS 1 or 2 message queued for a persistent session whose client is offline.
+type Message struct {
+	ID        uint   `gorm:"primary_key"`
+	ClientID  string `gorm:"not null;index"`
+	Topic     string `gorm:"not null"`
+	QoS       uint8  `gorm:"not null"`
+	Retain    bool   `gorm:"not null"`
+	Payload   []byte `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+type messageGorm struct {
+	db *gorm.DB
+}
+
+func NewMessageService(db *gorm.DB) MessageService {
+	return &messageGorm{
+		db,
+	}
+}
+
+type MessageService interface {
+	Create(message *Message) error
+	// All returns every queued message, oldest first.
+	All() ([]Message, error)
+	DeleteByClientID(clientID string) error
+}
+
+func (mg *messageGorm) Create(message *Message) error {
+	return mg.db.Create(message).Error
+}
+
+func (mg *messageGorm) All() ([]Message, error) {
+	var messages []Message
+	if err := mg.db.Order("id").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (mg *messageGorm) DeleteByClientID(clientID string) error {
+	return mg.db.Where("client_id = ?", clientID).Delete(&Message{}).Error
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password hashing algorithms.
+const (
+	BcryptHash   = "bcrypt"
+	Argon2idHash = "argon2id"
+)
+
+// Argon2id parameters for new hashes, the second recommended option of RFC 9106.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+
+	// Largest parameters accepted from stored hashes, so a bad hash can't
+	// exhaust the broker while checking a password.
+	maxArgon2Time   = 16
+	maxArgon2Memory = 1024 * 1024
+)
+
+var ErrUnknownHash = errors.New("Unknown password hash")
+
+// HashPassword hashes a password with the algorithm, argon2id hashes are
+// stored in the PHC string format.
+func HashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case BcryptHash:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case Argon2idHash:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", ErrUnknownHash
+}
+
+// CheckPassword reports whether the password matches a bcrypt or argon2id
+// hash, or a hash from a mosquitto password file.
+func CheckPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$7$"), strings.HasPrefix(hash, "$6$"):
+		return checkMosquitto(hash, password)
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return checkArgon2id(hash, password)
+	}
+	return false, ErrUnknownHash
+}
+
+func checkArgon2id(hash, password string) (bool, error) {
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, ErrUnknownHash
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, ErrUnknownHash
+	}
+	// argon2 panics with no passes or threads.
+	if time < 1 || time > maxArgon2Time || threads < 1 || memory > maxArgon2Memory {
+		return false, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, ErrUnknownHash
+	}
+
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+// checkMosquitto checks mosquitto's "$7$iterations$salt$hash" PBKDF2-SHA512
+// hashes, and the "$6$salt$hash" salted SHA512 hashes of older versions.
+func checkMosquitto(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	iterations := 0
+	if parts[1] == "7" {
+		if len(parts) != 5 {
+			return false, ErrUnknownHash
+		}
+		var err error
+		if iterations, err = strconv.Atoi(parts[2]); err != nil || iterations < 1 {
+			return false, ErrUnknownHash
+		}
+		parts = append(parts[:2], parts[3:]...)
+	}
+	if len(parts) != 4 {
+		return false, ErrUnknownHash
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) != sha512.Size {
+		return false, ErrUnknownHash
+	}
+
+	var got []byte
+	if iterations > 0 {
+		got = pbkdf2.Key([]byte(password), salt, iterations, sha512.Size, sha512.New)
+	} else {
+		sum := sha512.Sum512(append([]byte(password), salt...))
+		got = sum[:]
+	}
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
@@ -0,0 +1,50 @@
+package models
+
+import "testing"
+
+func TestPasswordHashes(t *testing.T) {
+	for _, algorithm := range []string{BcryptHash, Argon2idHash} {
+		t.Run(algorithm, func(t *testing.T) {
+			hash, err := HashPassword("correct horse", algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := CheckPassword(hash, "correct horse"); !ok || err != nil {
+				t.Errorf("CheckPassword() with the password = %v, %v", ok, err)
+			}
+			if ok, err := CheckPassword(hash, "battery staple"); ok || err != nil {
+				t.Errorf("CheckPassword() with another password = %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		want    bool
+		wantErr error
+	}{
+		// "password" hashed with the reference argon2 implementation.
+		{"argon2id reference hash", "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", true, nil},
+		{"argon2i is not supported", "$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$wWKIMhR9lyDFvRz9YTZweHKfbftvj+qf+YFY4NeBbtA", false, ErrUnknownHash},
+		{"argon2id without passes", "$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", false, ErrUnknownHash},
+		{"argon2id without threads", "$argon2id$v=19$m=65536,t=2,p=0$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", false, ErrUnknownHash},
+		{"argon2id too much memory", "$argon2id$v=19$m=4194304,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", false, ErrUnknownHash},
+		{"argon2id other version", "$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", false, ErrUnknownHash},
+		// "password" with the salt "0123456789ab", as written by mosquitto_passwd.
+		{"mosquitto PBKDF2-SHA512", "$7$101$MDEyMzQ1Njc4OWFi$uAhjSMFrFKPND0iWyTXsxET36hDBAvu7LqiX1au82iDOT9W7IG9XGjasDAepCB3nZMPp79k+PyCilDXRAZuIVA==", true, nil},
+		{"mosquitto salted SHA512", "$6$MDEyMzQ1Njc4OWFi$QQ3PWSJ3IyGPP66YMDh3aUdVyS29efC2oPtFLnz5O/EXQO4dovrApaaZv32acQ3b0Lt02H8GBYcsYpkBYYcERg==", true, nil},
+		{"mosquitto without iterations", "$7$MDEyMzQ1Njc4OWFi$uAhjSMFrFKPND0iWyTXsxET36hDBAvu7LqiX1au82iDOT9W7IG9XGjasDAepCB3nZMPp79k+PyCilDXRAZuIVA==", false, ErrUnknownHash},
+		{"plain text", "password", false, ErrUnknownHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CheckPassword(tt.hash, "password")
+			if got != tt.want || err != tt.wantErr {
+				t.Errorf("CheckPassword() = %v, %v, want %v, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,15 +1,18 @@
 package models
 
 import (
+	"sync"
+	"time"
+
 	"github.com/jinzhu/gorm"
-	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/naspinall/Hive-MQTT/pkg/topics"
 )
 
 type Retain struct {
-	ID      uint           `gorm:"primary_key"`
-	Topic   string         `gorm:"not null"`
-	QoS     uint           `gorm:"not null`
-	Message postgres.Jsonb `gorm:"not null"`
+	Topic     string `gorm:"primary_key"`
+	QoS       uint8  `gorm:"not null"`
+	Payload   []byte `gorm:"not null"`
+	UpdatedAt time.Time
 }
 
 type retainGorm struct {
@@ -23,4 +26,139 @@ func NewRetainService(db *gorm.DB) RetainService {
 }
 
 type RetainService interface {
+	// Set stores the retained message for a topic, replacing any existing one.
+	Set(retain *Retain) error
+	// Delete removes the retained message for a topic.
+	Delete(topic string) error
+	// Match returns the retained messages whose topics match a topic filter.
+	Match(filter string) ([]Retain, error)
+	// All returns every retained message.
+	All() ([]Retain, error)
+}
+
+func (rg *retainGorm) Set(retain *Retain) error {
+	return rg.db.Save(retain).Error
+}
+
+func (rg *retainGorm) Delete(topic string) error {
+	return rg.db.Where("topic = ?", topic).Delete(&Retain{}).Error
+}
+
+func (rg *retainGorm) Match(filter string) ([]Retain, error) {
+	retains, err := rg.All()
+	if err != nil {
+		return nil, err
+	}
+	return matchRetained(filter, retains), nil
+}
+
+func (rg *retainGorm) All() ([]Retain, error) {
+	var retains []Retain
+	if err := rg.db.Find(&retains).Error; err != nil {
+		return nil, err
+	}
+	return retains, nil
+}
+
+func matchRetained(filter string, retains []Retain) []Retain {
+	var matched []Retain
+	for _, retain := range retains {
+		if topics.Match(filter, retain.Topic) {
+			matched = append(matched, retain)
+		}
+	}
+	return matched
+}
+
+// retainCache keeps every retained message in memory, writing through to
+// the underlying service, so subscribes don't query the database.
+type retainCache struct {
+	RetainService
+
+	mu      sync.RWMutex
+	loaded  bool
+	retains map[string]Retain
+}
+
+// NewRetainCache puts an in memory cache in front of a RetainService. The
+// cache is filled on first use, so it can be created before migrations run.
+func NewRetainCache(rs RetainService) RetainService {
+	return &retainCache{
+		RetainService: rs,
+		retains:       make(map[string]Retain),
+	}
+}
+
+// load fills the cache from the underlying service. Must be called with rc.mu held.
+func (rc *retainCache) load() error {
+	if rc.loaded {
+		return nil
+	}
+	retains, err := rc.RetainService.All()
+	if err != nil {
+		return err
+	}
+	for _, retain := range retains {
+		rc.retains[retain.Topic] = retain
+	}
+	rc.loaded = true
+	return nil
+}
+
+func (rc *retainCache) Set(retain *Retain) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if err := rc.load(); err != nil {
+		return err
+	}
+	if err := rc.RetainService.Set(retain); err != nil {
+		return err
+	}
+	rc.retains[retain.Topic] = *retain
+	return nil
+}
+
+func (rc *retainCache) Delete(topic string) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if err := rc.load(); err != nil {
+		return err
+	}
+	if err := rc.RetainService.Delete(topic); err != nil {
+		return err
+	}
+	delete(rc.retains, topic)
+	return nil
+}
+
+func (rc *retainCache) Match(filter string) ([]Retain, error) {
+	retains, err := rc.All()
+	if err != nil {
+		return nil, err
+	}
+	return matchRetained(filter, retains), nil
+}
+
+func (rc *retainCache) All() ([]Retain, error) {
+	rc.mu.RLock()
+	if !rc.loaded {
+		// Upgrading to a write lock to fill the cache.
+		rc.mu.RUnlock()
+		rc.mu.Lock()
+		err := rc.load()
+		rc.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		rc.mu.RLock()
+	}
+	defer rc.mu.RUnlock()
+
+	retains := make([]Retain, 0, len(rc.retains))
+	for _, retain := range rc.retains {
+		retains = append(retains, retain)
+	}
+	return retains, nil
 }
@@ -0,0 +1,70 @@
+package models
+
+import "testing"
+
+// countingRetain is a RetainService backed by a map that counts reads.
+type countingRetain struct {
+	retains map[string]Retain
+	reads   int
+}
+
+func (cr *countingRetain) Set(retain *Retain) error {
+	cr.retains[retain.Topic] = *retain
+	return nil
+}
+
+func (cr *countingRetain) Delete(topic string) error {
+	delete(cr.retains, topic)
+	return nil
+}
+
+func (cr *countingRetain) Match(filter string) ([]Retain, error) {
+	retains, _ := cr.All()
+	return matchRetained(filter, retains), nil
+}
+
+func (cr *countingRetain) All() ([]Retain, error) {
+	cr.reads++
+	var retains []Retain
+	for _, retain := range cr.retains {
+		retains = append(retains, retain)
+	}
+	return retains, nil
+}
+
+func TestRetainCache(t *testing.T) {
+	backing := &countingRetain{retains: map[string]Retain{
+		"site/1/config": {Topic: "site/1/config", Payload: []byte("a")},
+		"$SYS/version":  {Topic: "$SYS/version", Payload: []byte("1")},
+	}}
+	rc := NewRetainCache(backing)
+
+	if err := rc.Set(&Retain{Topic: "site/2/config", Payload: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Delete("site/1/config"); err != nil {
+		t.Fatal(err)
+	}
+	loads := backing.reads
+
+	got, err := rc.Match("site/+/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Topic != "site/2/config" {
+		t.Errorf("Match() = %v, want site/2/config", got)
+	}
+	got, err = rc.Match("$SYS/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Errorf("Match() of system topics = %v, want $SYS/version", got)
+	}
+	if backing.reads != loads {
+		t.Errorf("Match() queried the backing service %d times after loading", backing.reads-loads)
+	}
+	if _, ok := backing.retains["site/1/config"]; ok {
+		t.Error("Delete() was not written through")
+	}
+}
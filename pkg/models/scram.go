@@ -0,0 +1,83 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Fewest iterations RFC 7677 allows for SCRAM-SHA-256.
+const DefaultScramIterations = 4096
+
+// ScramCredential is what the server keeps to verify a SCRAM-SHA-256
+// client, the password itself is never stored.
+type ScramCredential struct {
+	Username   string `gorm:"primary_key"`
+	Salt       []byte `gorm:"not null"`
+	Iterations int    `gorm:"not null"`
+	StoredKey  []byte `gorm:"not null"`
+	ServerKey  []byte `gorm:"not null"`
+}
+
+// NewScramCredential derives a credential for a password with a random salt.
+// Passwords are used as given, without SASLprep.
+func NewScramCredential(username, password string, iterations int) (*ScramCredential, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return &ScramCredential{
+		Username:   username,
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}, nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+type scramGorm struct {
+	db *gorm.DB
+}
+
+func NewScramService(db *gorm.DB) ScramService {
+	return &scramGorm{
+		db,
+	}
+}
+
+type ScramService interface {
+	// Create stores a user's credential, replacing any previous one.
+	Create(credential *ScramCredential) error
+	ByUsername(username string) (*ScramCredential, error)
+	Delete(username string) error
+}
+
+func (sg *scramGorm) Create(credential *ScramCredential) error {
+	return sg.db.Save(credential).Error
+}
+
+func (sg *scramGorm) ByUsername(username string) (*ScramCredential, error) {
+	var credential ScramCredential
+	if err := sg.db.Where("username = ?", username).First(&credential).Error; err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+func (sg *scramGorm) Delete(username string) error {
+	return sg.db.Where("username = ?", username).Delete(&ScramCredential{}).Error
+}
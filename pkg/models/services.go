@@ -1,12 +1,20 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"github.com/jinzhu/gorm"
+	// Registers the postgres driver WithGorm opens.
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
 
 type Services struct {
-	RetainService  RetainService
-	SessionService SessionService
-	WillService    WillService
-	db             *gorm.DB
+	RetainService       RetainService
+	SessionService      SessionService
+	WillService         WillService
+	SubscriptionService SubscriptionService
+	MessageService      MessageService
+	ScramService        ScramService
+	UserService         UserService
+	db                  *gorm.DB
 }
 
 type ServicesConfig func(*Services) error
@@ -35,7 +43,7 @@ func WithGorm(dialect, connectionInfo string) ServicesConfig {
 
 func WithRetain() ServicesConfig {
 	return func(s *Services) error {
-		s.RetainService = NewRetainService(s.db)
+		s.RetainService = NewRetainCache(NewRetainService(s.db))
 		return nil
 	}
 }
@@ -52,6 +60,54 @@ func WithWill() ServicesConfig {
 	}
 }
 
+func WithSubscription() ServicesConfig {
+	return func(s *Services) error {
+		s.SubscriptionService = NewSubscriptionService(s.db)
+		return nil
+	}
+}
+func WithMessage() ServicesConfig {
+	return func(s *Services) error {
+		s.MessageService = NewMessageService(s.db)
+		return nil
+	}
+}
+
+func WithScram() ServicesConfig {
+	return func(s *Services) error {
+		s.ScramService = NewScramService(s.db)
+		return nil
+	}
+}
+
+// WithUsers stores users with argon2id password hashes.
+func WithUsers() ServicesConfig {
+	return func(s *Services) error {
+		us, err := NewUserService(s.db, Argon2idHash)
+		if err != nil {
+			return err
+		}
+		s.UserService = us
+		return nil
+	}
+}
+
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&Will{}, &Session{}, &Retain{}).Error
+	if err := s.migrateRetain(); err != nil {
+		return err
+	}
+	return s.db.AutoMigrate(&Will{}, &Session{}, &Retain{}, &Subscription{}, &Message{}, &ScramCredential{}, &User{}, &UserACL{}).Error
+}
+
+// migrateRetain drops the retains table of earlier versions, keyed by an ID
+// with a jsonb message column, so AutoMigrate recreates it keyed by topic.
+// AutoMigrate only adds columns, and nothing was ever stored in the old table.
+func (s *Services) migrateRetain() error {
+	if !s.db.HasTable(&Retain{}) {
+		return nil
+	}
+	if !s.db.Dialect().HasColumn(s.db.NewScope(&Retain{}).TableName(), "message") {
+		return nil
+	}
+	return s.db.DropTable(&Retain{}).Error
 }
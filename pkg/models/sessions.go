@@ -10,9 +10,13 @@ type Session struct {
 	ClientID    string `gorm:"primary_key"`
 	Username    string
 	LastConnect time.Time
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
-	DeletedAt   *time.Time `sql:"index"`
+	// Seconds the session is kept after its client disconnects.
+	ExpiryInterval uint32
+	// Set when the client disconnects, nil while connected or if the session never expires.
+	ExpiresAt *time.Time `sql:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time `sql:"index"`
 }
 
 type sessionGorm struct {
@@ -26,9 +30,53 @@ func NewSessionService(db *gorm.DB) SessionService {
 }
 
 type SessionService interface {
+	// Create stores a session, replacing the session of a reconnecting client.
 	Create(session *Session) error
+	// Expire sets when a disconnected client's session expires.
+	Expire(clientID string, expiresAt *time.Time) error
+	// Expired returns the sessions that had expired by now.
+	Expired(now time.Time) ([]Session, error)
+	All() ([]Session, error)
+	Delete(clientID string) error
 }
 
 func (sg *sessionGorm) Create(session *Session) error {
-	return sg.db.Create(session).Error
+	var existing Session
+	err := sg.db.Where("client_id = ?", session.ClientID).First(&existing).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return sg.db.Create(session).Error
+	}
+	if err != nil {
+		return err
+	}
+	// Save writes every column, the replaced session keeps when it was first created.
+	session.CreatedAt = existing.CreatedAt
+	return sg.db.Save(session).Error
+}
+
+func (sg *sessionGorm) Expire(clientID string, expiresAt *time.Time) error {
+	return sg.db.Model(&Session{}).Where("client_id = ?", clientID).Update("expires_at", expiresAt).Error
+}
+
+func (sg *sessionGorm) Expired(now time.Time) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("expires_at IS NOT NULL AND expires_at <= ?", now).Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) All() ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Delete(clientID string) error {
+	// Expired sessions are removed outright rather than soft deleted.
+	return sg.db.Unscoped().Where("client_id = ?", clientID).Delete(&Session{}).Error
 }
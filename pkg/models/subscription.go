@@ -0,0 +1,50 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// Subscription is a topic filter held by a persistent session.
+type Subscription struct {
+	ClientID string `gorm:"primary_key"`
+	Filter   string `gorm:"primary_key"`
+	QoS      uint8  `gorm:"not null"`
+}
+
+type subscriptionGorm struct {
+	db *gorm.DB
+}
+
+func NewSubscriptionService(db *gorm.DB) SubscriptionService {
+	return &subscriptionGorm{
+		db,
+	}
+}
+
+type SubscriptionService interface {
+	// Create stores a subscription, replacing the client's existing subscription to the filter.
+	Create(subscription *Subscription) error
+	Delete(clientID string, filter string) error
+	DeleteByClientID(clientID string) error
+	All() ([]Subscription, error)
+}
+
+func (sg *subscriptionGorm) Create(subscription *Subscription) error {
+	return sg.db.Save(subscription).Error
+}
+
+func (sg *subscriptionGorm) Delete(clientID string, filter string) error {
+	return sg.db.Where("client_id = ? AND filter = ?", clientID, filter).Delete(&Subscription{}).Error
+}
+
+func (sg *subscriptionGorm) DeleteByClientID(clientID string) error {
+	return sg.db.Where("client_id = ?", clientID).Delete(&Subscription{}).Error
+}
+
+func (sg *subscriptionGorm) All() ([]Subscription, error) {
+	var subscriptions []Subscription
+	if err := sg.db.Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	ErrInvalidPassword = errors.New("Invalid password")
+	ErrUserDisabled    = errors.New("User disabled")
+	ErrUnknownUser     = errors.New("Unknown user")
+)
+
+// User is a client's login, checked when it connects.
+type User struct {
+	Username string `gorm:"primary_key"`
+	// Set to change the password, only the hash is stored.
+	Password     string `gorm:"-"`
+	PasswordHash string `gorm:"not null"`
+	// Disabled users can't connect.
+	Enabled bool `gorm:"not null"`
+	// Superusers can use every topic, their ACL rules are ignored.
+	Superuser bool `gorm:"not null"`
+	// Checked in order, the first rule matching a topic decides.
+	ACL       []UserACL `gorm:"foreignkey:Username;association_foreignkey:Username"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// UserACL allows or denies a user actions on the topics matching a filter.
+type UserACL struct {
+	ID       uint   `gorm:"primary_key"`
+	Username string `gorm:"index;not null"`
+	// Order of the rule within the user's ACL.
+	Position int `gorm:"not null"`
+	// Topic filter, %u and %c are replaced with the username and ClientID.
+	Topic        string `gorm:"not null"`
+	Publish      bool   `gorm:"not null"`
+	Subscribe    bool   `gorm:"not null"`
+	RetainedRead bool   `gorm:"not null"`
+	Deny         bool   `gorm:"not null"`
+}
+
+type userGorm struct {
+	db *gorm.DB
+	// Algorithm new passwords are hashed with.
+	algorithm string
+	// Checked for unknown users, so they take as long to refuse as a wrong password.
+	dummyHash string
+}
+
+// NewUserService stores users with new passwords hashed by the algorithm,
+// existing bcrypt and argon2id hashes are checked whatever it is.
+func NewUserService(db *gorm.DB, algorithm string) (UserService, error) {
+	dummyHash, err := HashPassword("", algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &userGorm{
+		db:        db,
+		algorithm: algorithm,
+		dummyHash: dummyHash,
+	}, nil
+}
+
+type UserService interface {
+	// Create stores a new user and its ACL rules, hashing its Password.
+	Create(user *User) error
+	// ByUsername returns a user with its ACL rules.
+	ByUsername(username string) (*User, error)
+	All() ([]User, error)
+	// Update saves a user, rehashing its Password if set. ACL rules are changed with SetACL.
+	Update(user *User) error
+	// SetACL replaces a user's ACL rules, keeping the order given.
+	SetACL(username string, rules []UserACL) error
+	// Delete removes a user and its ACL rules.
+	Delete(username string) error
+	// Authenticate returns the user if it is enabled and the password is
+	// right, ErrUnknownUser if there's no such user.
+	Authenticate(username, password string) (*User, error)
+	// Identify returns the user if it is enabled, for clients that proved
+	// who they are without a password. ErrUnknownUser if there's no such user.
+	Identify(username string) (*User, error)
+}
+
+// hashPassword replaces a user's Password with its hash.
+func (ug *userGorm) hashPassword(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	hash, err := HashPassword(user.Password, ug.algorithm)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	user.Password = ""
+	return nil
+}
+
+func (ug *userGorm) Create(user *User) error {
+	if err := ug.hashPassword(user); err != nil {
+		return err
+	}
+	for i := range user.ACL {
+		user.ACL[i].Username = user.Username
+		user.ACL[i].Position = i
+	}
+	return ug.db.Create(user).Error
+}
+
+func (ug *userGorm) ByUsername(username string) (*User, error) {
+	var user User
+	err := ug.db.Preload("ACL", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Where("username = ?", username).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (ug *userGorm) All() ([]User, error) {
+	var users []User
+	if err := ug.db.Order("username").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (ug *userGorm) Update(user *User) error {
+	if err := ug.hashPassword(user); err != nil {
+		return err
+	}
+	return ug.db.Set("gorm:association_autoupdate", false).Save(user).Error
+}
+
+func (ug *userGorm) SetACL(username string, rules []UserACL) error {
+	return ug.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("username = ?", username).Delete(&UserACL{}).Error; err != nil {
+			return err
+		}
+		for i, rule := range rules {
+			rule.ID = 0
+			rule.Username = username
+			rule.Position = i
+			if err := tx.Create(&rule).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ug *userGorm) Delete(username string) error {
+	return ug.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("username = ?", username).Delete(&UserACL{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("username = ?", username).Delete(&User{}).Error
+	})
+}
+
+func (ug *userGorm) Authenticate(username, password string) (*User, error) {
+	user, err := ug.ByUsername(username)
+	if gorm.IsRecordNotFoundError(err) {
+		CheckPassword(ug.dummyHash, password)
+		return nil, ErrUnknownUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	ok, err := CheckPassword(user.PasswordHash, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidPassword
+	}
+	if !user.Enabled {
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
+
+func (ug *userGorm) Identify(username string) (*User, error) {
+	user, err := ug.ByUsername(username)
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrUnknownUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.Enabled {
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
@@ -2,14 +2,16 @@ package models
 
 import (
 	"github.com/jinzhu/gorm"
-	"github.com/jinzhu/gorm/dialects/postgres"
 )
 
 type Will struct {
-	ClientID string          `gorm:"primary_key"`
-	QoS      uint8           `gorm:"not null`
-	Message  *postgres.Jsonb `gorm:"not null"`
-	Topic    string          `gorm:"not null"`
+	ClientID string `gorm:"primary_key"`
+	QoS      uint8  `gorm:"not null"`
+	Retain   bool   `gorm:"not null"`
+	Payload  []byte `gorm:"not null"`
+	Topic    string `gorm:"not null"`
+	// Seconds to wait after the connection ends before publishing.
+	DelayInterval uint32
 }
 
 type willGorm struct {
@@ -23,9 +25,10 @@ func NewWillService(db *gorm.DB) WillService {
 }
 
 type WillService interface {
+	// Create stores a client's will, replacing any will from a previous connection.
 	Create(will *Will) error
 }
 
 func (wg *willGorm) Create(will *Will) error {
-	return wg.db.Create(will).Error
+	return wg.db.Save(will).Error
 }
@@ -1 +1,84 @@
 package packets
+
+import (
+	"bytes"
+	"errors"
+)
+
+var ErrInvalidAuthReasonCode = errors.New("Invalid AUTH reason code")
+
+// AuthPacket carries a step of an MQTT 5 enhanced authentication exchange.
+type AuthPacket struct {
+	Packet
+	ReasonCode byte
+	Properties Properties
+}
+
+func NewAuthPacket(p *Packet) (*AuthPacket, error) {
+	if p.Flags != (FixedHeaderFlags{}) {
+		return nil, ErrMalformedPacket
+	}
+	ap := &AuthPacket{Packet: *p}
+	// An empty AUTH is a successful one.
+	if ap.buff.Len() == 0 {
+		return ap, nil
+	}
+	rc, err := ap.DecodeByte()
+	if err != nil {
+		return nil, err
+	}
+	switch rc {
+	case Success, ContinueAuthentication, ReAuthenticate:
+		ap.ReasonCode = rc
+	default:
+		return nil, ErrInvalidAuthReasonCode
+	}
+	if ap.buff.Len() > 0 {
+		properties, err := ap.DecodePropertySection(AUTH)
+		if err != nil {
+			return nil, err
+		}
+		ap.Properties = properties
+	}
+	return ap, nil
+}
+
+func (ap *AuthPacket) Encode() ([]byte, error) {
+	if ap.ReasonCode != Success || len(ap.Properties) > 0 {
+		if err := ap.EncodeByte(ap.ReasonCode); err != nil {
+			return nil, err
+		}
+		if err := ap.EncodePropertySection(AUTH, ap.Properties); err != nil {
+			return nil, err
+		}
+	}
+	return ap.EncodeFixedHeader()
+}
+
+// Method returns the authentication method the exchange is using.
+func (ap *AuthPacket) Method() string {
+	method, _ := ap.Properties.String(AuthenticationMethodIdentifier)
+	return method
+}
+
+// Data returns the authentication data for this step, if any.
+func (ap *AuthPacket) Data() []byte {
+	data, _ := ap.Properties.Binary(AuthenticationDataIdentifier)
+	return data
+}
+
+// Auth builds an AUTH packet continuing, completing or restarting an exchange.
+func Auth(rc byte, method string, data []byte) *AuthPacket {
+	ap := &AuthPacket{
+		Packet: Packet{
+			Type: AUTH,
+			buff: &bytes.Buffer{},
+		},
+		ReasonCode: rc,
+	}
+	ap.Properties.Add(AuthenticationMethodIdentifier, method)
+	if data != nil {
+		ap.Properties.Add(AuthenticationDataIdentifier, data)
+	}
+	return ap
+}
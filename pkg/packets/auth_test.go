@@ -0,0 +1,75 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAuthRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		ap   *AuthPacket
+		want []byte
+	}{
+		{
+			name: "continue with data",
+			ap:   Auth(ContinueAuthentication, "M", []byte{1, 2}),
+			want: []byte{0xF0, 11, 0x18, 9, 0x15, 0, 1, 'M', 0x16, 0, 2, 1, 2},
+		},
+		{
+			name: "re-authenticate without data",
+			ap:   Auth(ReAuthenticate, "M", nil),
+			want: []byte{0xF0, 6, 0x19, 4, 0x15, 0, 1, 'M'},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ap.SetVersion(MQTT5)
+			b, err := tt.ap.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tt.want) {
+				t.Fatalf("Encode() = %v, want %v", b, tt.want)
+			}
+
+			p, err := NewMQTTPacket(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Version = MQTT5
+			got, err := NewAuthPacket(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ReasonCode != tt.ap.ReasonCode || got.Method() != tt.ap.Method() || !bytes.Equal(got.Data(), tt.ap.Data()) {
+				t.Errorf("NewAuthPacket() = %d %q %v, want %d %q %v", got.ReasonCode, got.Method(), got.Data(), tt.ap.ReasonCode, tt.ap.Method(), tt.ap.Data())
+			}
+		})
+	}
+}
+
+func TestNewAuthPacketValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr error
+	}{
+		{"empty is success", []byte{0xF0, 0}, nil},
+		{"reason code without properties", []byte{0xF0, 1, 0x18}, nil},
+		{"reserved flags", []byte{0xF2, 0}, ErrMalformedPacket},
+		{"invalid reason code", []byte{0xF0, 1, 0x87}, ErrInvalidAuthReasonCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewMQTTPacket(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Version = MQTT5
+			if _, err := NewAuthPacket(p); err != tt.wantErr {
+				t.Errorf("NewAuthPacket() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
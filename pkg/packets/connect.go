@@ -1,6 +1,23 @@
 package packets
 
-import "bytes"
+import (
+	"bytes"
+	"errors"
+)
+
+// Protocol Levels
+const (
+	MQTT31  = 0x03 //MQTT 3.1, protocol name MQIsdp
+	MQTT311 = 0x04 //MQTT 3.1.1
+	MQTT5   = 0x05 //MQTT 5.0
+)
+
+var (
+	ErrConnectReservedFlag     = errors.New("Reserved connect flag must be zero")
+	ErrInvalidWillFlags        = errors.New("Invalid will QoS or retain flag")
+	ErrPasswordWithoutUsername = errors.New("Password flag set without username flag")
+	ErrUnsupportedProtocol     = errors.New("Unsupported protocol name or level")
+)
 
 type WillProperties struct {
 	WillDelayInterval      uint32
@@ -9,7 +26,7 @@ type WillProperties struct {
 	ContentType            string
 	ResponseTopic          string
 	CorrelationData        []byte
-	UserProperty           *StringPair
+	UserProperties         []StringPair
 }
 
 type ConnectPacket struct {
@@ -35,7 +52,7 @@ type ConnectPacket struct {
 	RequestProblemInformation  bool
 	RecieveMaximum             uint16
 	TopicAliasMaximum          uint16
-	UserProperty               *StringPair
+	UserProperties             []StringPair
 	MaximumPacketSize          uint32
 
 	//Payload properties
@@ -51,6 +68,9 @@ type ConnackPacket struct {
 	Packet
 	SessionPresent byte
 	ReturnCode     byte
+
+	// MQTT 5 only.
+	Properties Properties
 }
 
 func NewConnackPacket(b []byte) (*ConnackPacket, error) {
@@ -59,12 +79,24 @@ func NewConnackPacket(b []byte) (*ConnackPacket, error) {
 		return nil, err
 	}
 
+	sp, err := p.DecodeByte()
+	if err != nil {
+		return nil, err
+	}
 	rc, err := p.DecodeByte()
 	if err != nil {
 		return nil, err
 	}
 
-	return &ConnackPacket{Packet: *p, ReturnCode: rc}, nil
+	cp := &ConnackPacket{Packet: *p, SessionPresent: sp, ReturnCode: rc}
+	// Only MQTT 5 CONNACKs have anything after the return code.
+	if cp.buff.Len() > 0 {
+		cp.Version = MQTT5
+		if cp.Properties, err = cp.DecodePropertySection(CONNACK); err != nil {
+			return nil, err
+		}
+	}
+	return cp, nil
 
 }
 
@@ -73,14 +105,18 @@ func NewConnectPacket(p *Packet) (*ConnectPacket, error) {
 		Packet: *p,
 	}
 
-	err := cp.DecodeProtocolVersion()
+	err := cp.DecodeProtocolName()
 	if err != nil {
 		return nil, err
 	}
-	err = cp.DecodeProtocolName()
+	err = cp.DecodeProtocolVersion()
 	if err != nil {
 		return nil, err
 	}
+	// The rest of the packet's layout depends on the protocol level.
+	if !SupportedProtocol(cp.ProtocolName, cp.ProtocolVersion) {
+		return nil, ErrUnsupportedProtocol
+	}
 	err = cp.DecodeConnectFlags()
 	if err != nil {
 		return nil, err
@@ -89,51 +125,96 @@ func NewConnectPacket(p *Packet) (*ConnectPacket, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = cp.DecodeProperties()
+	if err != nil {
+		return nil, err
+	}
 	err = cp.DecodePayload()
 	if err != nil {
 		return nil, err
 	}
+	// Nothing follows the payload.
+	if cp.buff.Len() > 0 {
+		return nil, ErrMalformedPacket
+	}
 	return cp, nil
 }
 
-func (cp ConnectPacket) DecodeProtocolName() error {
-	p := cp.DecodeString()
+func (cp *ConnectPacket) DecodeProtocolName() error {
+	p, err := cp.DecodeString()
 	cp.ProtocolName = p
-	return nil
+	return err
 }
 
-func (cp ConnectPacket) EncodeProtocolName() error {
-	return cp.EncodeString(cp.ProtocolName)
+func (cp *ConnectPacket) EncodeProtocolName() error {
+	name := cp.ProtocolName
+	if name == "" {
+		name = ProtocolName(cp.ProtocolVersion)
+	}
+	return cp.EncodeString(name)
 }
 
-func (cp ConnectPacket) DecodeProtocolVersion() error {
+// ProtocolName returns the protocol name sent with a protocol level, MQTT 3.1 used MQIsdp.
+func ProtocolName(version byte) string {
+	if version == MQTT31 {
+		return "MQIsdp"
+	}
+	return "MQTT"
+}
+
+// SupportedProtocol reports whether a protocol name and level pair is one the
+// broker speaks: MQIsdp/3, MQTT/4 or MQTT/5.
+func SupportedProtocol(name string, version byte) bool {
+	switch version {
+	case MQTT31:
+		return name == "MQIsdp"
+	case MQTT311, MQTT5:
+		return name == "MQTT"
+	}
+	return false
+}
+
+func (cp *ConnectPacket) DecodeProtocolVersion() error {
 	v, err := cp.DecodeByte()
 	if err != nil {
 		return err
 	}
 	cp.ProtocolVersion = v
+	cp.Version = v
 	return nil
 }
 
-func (cp ConnectPacket) EncodeProtocolVersion() error {
+func (cp *ConnectPacket) EncodeProtocolVersion() error {
 	return cp.EncodeByte(cp.ProtocolVersion)
 }
 
-func (cp ConnectPacket) DecodeConnectFlags() error {
+func (cp *ConnectPacket) DecodeConnectFlags() error {
 	fb, err := cp.DecodeByte()
 	if err != nil {
 		return err
 	}
-	cp.UsernameFlag = fb>>6 > 0
-	cp.PasswordFlag = (fb&0x40)>>5 > 0
-	cp.WillRetainFlag = (fb&0x20)>>4 > 0
+	if fb&0x01 != 0 {
+		return ErrConnectReservedFlag
+	}
+	cp.UsernameFlag = fb&0x80 > 0
+	cp.PasswordFlag = fb&0x40 > 0
+	cp.WillRetainFlag = fb&0x20 > 0
 	cp.WillQoSFlag = (fb & 0x18) >> 3
-	cp.WillFlag = fb>>6 > 0
-	cp.CleanStartFlag = fb>>7 > 0
+	cp.WillFlag = fb&0x04 > 0
+	cp.CleanStartFlag = fb&0x02 > 0
+
+	// Will QoS and retain only mean something alongside a will.
+	if cp.WillQoSFlag > 2 || (!cp.WillFlag && (cp.WillQoSFlag != 0 || cp.WillRetainFlag)) {
+		return ErrInvalidWillFlags
+	}
+	// Before MQTT 5 a password can't be sent without a username.
+	if cp.PasswordFlag && !cp.UsernameFlag && cp.ProtocolVersion < MQTT5 {
+		return ErrPasswordWithoutUsername
+	}
 	return nil
 }
 
-func (cp ConnectPacket) EncodeConnectFlags(b []byte) ([]byte, error) {
+func (cp *ConnectPacket) EncodeConnectFlags() error {
 	var flags byte
 	if cp.UsernameFlag {
 		flags = flags | (uint8(1) << 7)
@@ -144,9 +225,7 @@ func (cp ConnectPacket) EncodeConnectFlags(b []byte) ([]byte, error) {
 	if cp.WillRetainFlag {
 		flags = flags | (uint8(1) << 5)
 	}
-	if cp.WillQoSFlag != 0 {
-		flags = flags | (uint8(3) << 4)
-	}
+	flags = flags | (cp.WillQoSFlag&0x03)<<3
 	if cp.WillFlag {
 		flags = flags | (uint8(1) << 2)
 	}
@@ -154,27 +233,96 @@ func (cp ConnectPacket) EncodeConnectFlags(b []byte) ([]byte, error) {
 		flags = flags | (uint8(1) << 1)
 	}
 
-	return append(b, flags), nil
+	return cp.EncodeByte(flags)
 }
 
-func (cp ConnectPacket) DecodeKeepAlive() error {
-	ka := cp.DecodeTwoByteInt()
+func (cp *ConnectPacket) DecodeKeepAlive() error {
+	ka, err := cp.DecodeTwoByteInt()
 	cp.KeepAlive = ka
-	return nil
+	return err
 }
 
-func (cp ConnectPacket) EncodeKeepAlive() error {
+func (cp *ConnectPacket) EncodeKeepAlive() error {
 	return cp.EncodeTwoByteInt(cp.KeepAlive)
 }
 
-func (cp ConnectPacket) DecodePayload() error {
+// DecodeProperties decodes the MQTT 5 properties that follow the keep alive.
+func (cp *ConnectPacket) DecodeProperties() error {
+	// Problem information is sent unless the client asks otherwise.
+	cp.RequestProblemInformation = true
+	if cp.ProtocolVersion < MQTT5 {
+		return nil
+	}
+
+	properties, err := cp.DecodePropertySection(CONNECT)
+	if err != nil {
+		return err
+	}
+	cp.SessionExpiryInterval, _ = properties.Uint32(SessionExpiryIntervalIdentifier)
+	cp.RecieveMaximum, _ = properties.Uint16(ReceiveMaximumIdentifier)
+	cp.MaximumPacketSize, _ = properties.Uint32(MaximumPacketSizeIdentifier)
+	cp.TopicAliasMaximum, _ = properties.Uint16(TopicAliasMaximumIdentifier)
+	if rri, ok := properties.Byte(RequestResponseInformationIdentifier); ok {
+		cp.RequestResponseInformation = rri == 1
+	}
+	if rpi, ok := properties.Byte(RequestProblemInformationIdentifier); ok {
+		cp.RequestProblemInformation = rpi == 1
+	}
+	cp.UserProperties = properties.UserProperties()
+	cp.AuthMethod, _ = properties.String(AuthenticationMethodIdentifier)
+	cp.AuthData, _ = properties.Binary(AuthenticationDataIdentifier)
+	return nil
+}
+
+// EncodeProperties encodes the MQTT 5 properties that follow the keep alive.
+func (cp *ConnectPacket) EncodeProperties() error {
+	if cp.ProtocolVersion < MQTT5 {
+		return nil
+	}
+
+	var properties Properties
+	if cp.SessionExpiryInterval != 0 {
+		properties.Add(SessionExpiryIntervalIdentifier, cp.SessionExpiryInterval)
+	}
+	if cp.RecieveMaximum != 0 {
+		properties.Add(ReceiveMaximumIdentifier, cp.RecieveMaximum)
+	}
+	if cp.MaximumPacketSize != 0 {
+		properties.Add(MaximumPacketSizeIdentifier, cp.MaximumPacketSize)
+	}
+	if cp.TopicAliasMaximum != 0 {
+		properties.Add(TopicAliasMaximumIdentifier, cp.TopicAliasMaximum)
+	}
+	if cp.RequestResponseInformation {
+		properties.Add(RequestResponseInformationIdentifier, byte(1))
+	}
+	if !cp.RequestProblemInformation {
+		properties.Add(RequestProblemInformationIdentifier, byte(0))
+	}
+	for _, up := range cp.UserProperties {
+		properties.Add(UserPropertyIdentifier, up)
+	}
+	if cp.AuthMethod != "" {
+		properties.Add(AuthenticationMethodIdentifier, cp.AuthMethod)
+	}
+	if cp.AuthData != nil {
+		properties.Add(AuthenticationDataIdentifier, cp.AuthData)
+	}
+	return cp.EncodePropertySection(CONNECT, properties)
+}
+
+func (cp *ConnectPacket) DecodePayload() error {
 
 	err := cp.DecodeClientID()
 	if err != nil {
 		return err
 	}
-	// If willflag is set to 1, will topic is the next in the payload.
+	// If willflag is set to 1, will properties, topic and message are next in the payload.
 	if cp.WillFlag {
+		err = cp.DecodeWillProperties()
+		if err != nil {
+			return err
+		}
 		err = cp.DecodeWillTopic()
 		if err != nil {
 			return err
@@ -185,12 +333,14 @@ func (cp ConnectPacket) DecodePayload() error {
 		}
 	}
 
-	// If Username is set, username and password are next in the payload.
+	// Username and password are next in the payload if their flags are set.
 	if cp.UsernameFlag {
 		err = cp.DecodeUsername()
 		if err != nil {
 			return err
 		}
+	}
+	if cp.PasswordFlag {
 		err = cp.DecodePassword()
 		if err != nil {
 			return err
@@ -200,59 +350,146 @@ func (cp ConnectPacket) DecodePayload() error {
 	return nil
 }
 
-func (cp ConnectPacket) DecodeWillTopic() error {
-	cp.WillTopic = cp.DecodeString()
+func (cp *ConnectPacket) EncodePayload() error {
+	if err := cp.EncodeClientID(); err != nil {
+		return err
+	}
+	if cp.WillFlag {
+		if err := cp.EncodeWillProperties(); err != nil {
+			return err
+		}
+		if err := cp.EncodeString(cp.WillTopic); err != nil {
+			return err
+		}
+		if err := cp.EncodeBinary(cp.WillPayload); err != nil {
+			return err
+		}
+	}
+	if cp.UsernameFlag {
+		if err := cp.EncodeString(cp.Username); err != nil {
+			return err
+		}
+	}
+	if cp.PasswordFlag {
+		if err := cp.EncodeBinary(cp.Password); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (cp ConnectPacket) DecodeWillMessage() error {
-	//cp.WillPayload = cp.DecodeBinaryData() // TODO Implement this
+// DecodeWillProperties decodes the MQTT 5 properties that come before the will topic.
+func (cp *ConnectPacket) DecodeWillProperties() error {
+	if cp.ProtocolVersion < MQTT5 {
+		return nil
+	}
+
+	properties, err := cp.DecodePropertySection(willProperties)
+	if err != nil {
+		return err
+	}
+	wp := &WillProperties{}
+	wp.WillDelayInterval, _ = properties.Uint32(WillDelayIntervalIdentifier)
+	if pfi, ok := properties.Byte(PayloadFormatIndicatorIdentifier); ok {
+		wp.PayloadFormatIndicator = pfi == 1
+	}
+	wp.MessageExpiryInterval, _ = properties.Uint32(MessageExpiryIntervalIdentifier)
+	wp.ContentType, _ = properties.String(ContentTypeIdentifier)
+	wp.ResponseTopic, _ = properties.String(ResponseTopicIdentifier)
+	wp.CorrelationData, _ = properties.Binary(CorrelationDataIdentifier)
+	wp.UserProperties = properties.UserProperties()
+	cp.WillProperties = wp
 	return nil
 }
 
-func (cp ConnectPacket) DecodeUsername() error {
-	cp.Username = cp.DecodeString()
-	return nil
+// EncodeWillProperties encodes the MQTT 5 properties that come before the will topic.
+func (cp *ConnectPacket) EncodeWillProperties() error {
+	if cp.ProtocolVersion < MQTT5 {
+		return nil
+	}
+
+	var properties Properties
+	if wp := cp.WillProperties; wp != nil {
+		if wp.WillDelayInterval != 0 {
+			properties.Add(WillDelayIntervalIdentifier, wp.WillDelayInterval)
+		}
+		if wp.PayloadFormatIndicator {
+			properties.Add(PayloadFormatIndicatorIdentifier, byte(1))
+		}
+		if wp.MessageExpiryInterval != 0 {
+			properties.Add(MessageExpiryIntervalIdentifier, wp.MessageExpiryInterval)
+		}
+		if wp.ContentType != "" {
+			properties.Add(ContentTypeIdentifier, wp.ContentType)
+		}
+		if wp.ResponseTopic != "" {
+			properties.Add(ResponseTopicIdentifier, wp.ResponseTopic)
+		}
+		if wp.CorrelationData != nil {
+			properties.Add(CorrelationDataIdentifier, wp.CorrelationData)
+		}
+		for _, up := range wp.UserProperties {
+			properties.Add(UserPropertyIdentifier, up)
+		}
+	}
+	return cp.EncodePropertySection(willProperties, properties)
 }
 
-func (cp ConnectPacket) DecodePassword() error {
-	//cp.Password = cp.DecodeBinaryData() // TODO Implement this
-	return nil
+func (cp *ConnectPacket) DecodeWillTopic() error {
+	var err error
+	cp.WillTopic, err = cp.DecodeString()
+	return err
 }
 
-func (cp ConnectPacket) DecodeClientID() error {
-	cp.ClientID = cp.DecodeString()
-	return nil
+func (cp *ConnectPacket) DecodeWillMessage() error {
+	var err error
+	cp.WillPayload, err = cp.DecodeBinaryData()
+	return err
+}
+
+func (cp *ConnectPacket) DecodeUsername() error {
+	var err error
+	cp.Username, err = cp.DecodeString()
+	return err
 }
 
-func (cp ConnectPacket) EncodeClientID() error {
+func (cp *ConnectPacket) DecodePassword() error {
+	var err error
+	cp.Password, err = cp.DecodeBinaryData()
+	return err
+}
+
+func (cp *ConnectPacket) DecodeClientID() error {
+	var err error
+	cp.ClientID, err = cp.DecodeString()
+	return err
+}
+
+func (cp *ConnectPacket) EncodeClientID() error {
 	return cp.EncodeString(cp.ClientID)
 }
 
-func (cp ConnectPacket) Encode() ([]byte, error) {
+func (cp *ConnectPacket) Encode() ([]byte, error) {
+	cp.Type = CONNECT
+	cp.buff = &bytes.Buffer{}
 
 	// Starting from the variable header, fixed header is last.
-
-	err := cp.EncodeString("MQTT")
-	if err != nil {
+	if err := cp.EncodeProtocolName(); err != nil {
 		return nil, err
 	}
-
-	// Protocol Level revision level used by this client, we are using revision 4
-	err = cp.EncodeByte(uint8(4))
-	if err != nil {
+	if err := cp.EncodeProtocolVersion(); err != nil {
 		return nil, err
 	}
-
-	// Keepalive of the packet
-	err = cp.EncodeTwoByteInt(cp.KeepAlive)
-	if err != nil {
+	if err := cp.EncodeConnectFlags(); err != nil {
 		return nil, err
 	}
-
-	// Encoding the Client Identifier
-	err = cp.EncodeString(cp.ClientID)
-	if err != nil {
+	if err := cp.EncodeKeepAlive(); err != nil {
+		return nil, err
+	}
+	if err := cp.EncodeProperties(); err != nil {
+		return nil, err
+	}
+	if err := cp.EncodePayload(); err != nil {
 		return nil, err
 	}
 
@@ -264,24 +501,35 @@ func (cp ConnackPacket) Encode() ([]byte, error) {
 		return nil, err
 	}
 
-	if err := cp.EncodeByte(cp.ReturnCode); err != nil {
+	// Builders use 3.1.1 return codes, MQTT 5 has its own for each of them.
+	if err := cp.EncodeByte(connackReturnCode(cp.ReturnCode, cp.Version)); err != nil {
 		return nil, err
 	}
 
+	if cp.Version >= MQTT5 {
+		if err := cp.EncodePropertySection(CONNACK, cp.Properties); err != nil {
+			return nil, err
+		}
+	}
+
 	//Connack is just the fixed header and the return code.
 	return cp.EncodeFixedHeader()
 }
 
-func Accepted() ConnackPacket {
+func Accepted(sessionPresent bool) ConnackPacket {
 	p := &Packet{
 		RemaningLength: 2,
 		Type:           CONNACK,
 		buff:           &bytes.Buffer{},
 	}
 
+	var sp byte
+	if sessionPresent {
+		sp = 1
+	}
 	return ConnackPacket{
 		Packet:         *p,
-		SessionPresent: 1,
+		SessionPresent: sp,
 		ReturnCode:     ConnectionAccepted,
 	}
 }
@@ -341,3 +589,17 @@ func NotAuth() ConnackPacket {
 		ReturnCode:     NotAuthorised,
 	}
 }
+
+// Refused builds a CONNACK refusing the connection with any return code, MQTT 5
+// reason codes without a 3.1.1 equivalent are server unavailable to older clients.
+func Refused(returnCode byte) ConnackPacket {
+	p := &Packet{
+		RemaningLength: 2,
+		Type:           CONNACK,
+		buff:           &bytes.Buffer{},
+	}
+	return ConnackPacket{Packet: *p,
+		SessionPresent: 0,
+		ReturnCode:     returnCode,
+	}
+}
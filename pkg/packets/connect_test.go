@@ -1 +1,172 @@
 package packets
+
+import (
+	"reflect"
+	"testing"
+)
+
+func decodeConnect(t *testing.T, b []byte) (*ConnectPacket, error) {
+	t.Helper()
+	p, err := NewMQTTPacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewConnectPacket(p)
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		cp   *ConnectPacket
+	}{
+		{
+			name: "MQTT 3.1",
+			cp: &ConnectPacket{
+				ProtocolName:              "MQIsdp",
+				ProtocolVersion:           MQTT31,
+				KeepAlive:                 30,
+				RequestProblemInformation: true,
+				CleanStartFlag:            true,
+				ClientID:                  "logger-1",
+			},
+		},
+		{
+			name: "MQTT 3.1.1 with will and credentials",
+			cp: &ConnectPacket{
+				ProtocolName:              "MQTT",
+				ProtocolVersion:           MQTT311,
+				KeepAlive:                 60,
+				RequestProblemInformation: true,
+				UsernameFlag:              true,
+				PasswordFlag:              true,
+				WillFlag:                  true,
+				WillQoSFlag:               1,
+				WillRetainFlag:            true,
+				ClientID:                  "sensor-1",
+				WillTopic:                 "presence/sensor-1",
+				WillPayload:               []byte{0, 1, 2},
+				Username:                  "sensor",
+				Password:                  []byte{0xFF, 0x00, 's', 'e', 'c'},
+			},
+		},
+		{
+			name: "MQTT 5 with properties",
+			cp: &ConnectPacket{
+				ProtocolName:               "MQTT",
+				ProtocolVersion:            MQTT5,
+				KeepAlive:                  10,
+				RequestProblemInformation:  true,
+				PasswordFlag:               true,
+				WillFlag:                   true,
+				WillQoSFlag:                2,
+				SessionExpiryInterval:      3600,
+				RecieveMaximum:             10,
+				MaximumPacketSize:          1024,
+				TopicAliasMaximum:          5,
+				RequestResponseInformation: true,
+				UserProperties:             []StringPair{{"site", "a"}, {"site", "b"}},
+				AuthMethod:                 "SCRAM-SHA-256",
+				AuthData:                   []byte("n,,n=user"),
+				ClientID:                   "gateway-1",
+				WillProperties: &WillProperties{
+					WillDelayInterval:      30,
+					PayloadFormatIndicator: true,
+					MessageExpiryInterval:  120,
+					ContentType:            "text/plain",
+					ResponseTopic:          "replies/gateway-1",
+					CorrelationData:        []byte{9},
+					UserProperties:         []StringPair{{"reason", "offline"}},
+				},
+				WillTopic:   "presence/gateway-1",
+				WillPayload: []byte("gone"),
+				Password:    []byte("token"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.cp.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeConnect(t, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := *tt.cp
+			got.Packet, want.Packet = Packet{}, Packet{}
+			if !reflect.DeepEqual(got, &want) {
+				t.Errorf("NewConnectPacket() = %+v, want %+v", got, &want)
+			}
+		})
+	}
+}
+
+func TestConnectFlagValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		flags   byte
+		wantErr error
+	}{
+		{"reserved bit set", MQTT311, 0x03, ErrConnectReservedFlag},
+		{"will QoS 3", MQTT311, 0x1C, ErrInvalidWillFlags},
+		{"will QoS without will", MQTT311, 0x08, ErrInvalidWillFlags},
+		{"will retain without will", MQTT311, 0x20, ErrInvalidWillFlags},
+		{"password without username", MQTT311, 0x40, ErrPasswordWithoutUsername},
+		{"MQTT 5 password without username", MQTT5, 0x40, nil},
+		{"clean start", MQTT311, 0x02, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := []byte{0x10, 0, 0, 4, 'M', 'Q', 'T', 'T', tt.version, tt.flags, 0, 0}
+			if tt.version == MQTT5 {
+				// Empty property section.
+				b = append(b, 0)
+			}
+			b = append(b, 0, 1, 'c')
+			if tt.flags&0x40 != 0 {
+				b = append(b, 0, 2, 'p', 'w')
+			}
+			b[1] = byte(len(b) - 2)
+
+			cp, err := decodeConnect(t, b)
+			if err != tt.wantErr {
+				t.Fatalf("NewConnectPacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && tt.flags&0x40 != 0 && string(cp.Password) != "pw" {
+				t.Errorf("Password = %q, want %q", cp.Password, "pw")
+			}
+		})
+	}
+}
+
+func TestConnectTruncated(t *testing.T) {
+	header := []byte{0, 4, 'M', 'Q', 'T', 'T', MQTT311}
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"empty", []byte{}},
+		{"protocol name length only", []byte{0}},
+		{"protocol name cut short", []byte{0, 4, 'M', 'Q'}},
+		{"no connect flags", header},
+		{"no keep alive", append(header, 0x02, 0)},
+		{"no client identifier", append(header, 0x02, 0, 0)},
+		{"client identifier cut short", append(header, 0x02, 0, 0, 0, 5, 'c')},
+		{"missing will", append(header, 0x06, 0, 0, 0, 1, 'c')},
+		{"missing username", append(header, 0xC2, 0, 0, 0, 1, 'c')},
+		{"missing password", append(header, 0xC2, 0, 0, 0, 1, 'c', 0, 1, 'u')},
+		{"trailing bytes", append(header, 0x02, 0, 0, 0, 1, 'c', 0xFF)},
+		{"MQTT 5 no properties", []byte{0, 4, 'M', 'Q', 'T', 'T', MQTT5, 0x02, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte{0x10, byte(len(tt.body))}, tt.body...)
+			if _, err := decodeConnect(t, b); err != ErrMalformedPacket {
+				t.Errorf("NewConnectPacket() error = %v, want %v", err, ErrMalformedPacket)
+			}
+		})
+	}
+}
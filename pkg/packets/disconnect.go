@@ -1,14 +1,70 @@
 package packets
 
+import "bytes"
+
 type DisconnectPacket struct {
 	Packet
+	ReasonCode byte
+	Properties Properties
 }
 
 func NewDisconnectPacket(p *Packet) (*DisconnectPacket, error) {
-	dp := &DisconnectPacket{*p}
+	dp := &DisconnectPacket{Packet: *p}
+	// Reason code can be left out for a normal disconnection.
+	if dp.buff.Len() > 0 {
+		rc, err := dp.DecodeByte()
+		if err != nil {
+			return nil, err
+		}
+		dp.ReasonCode = rc
+	}
+	// Properties can be left out too.
+	if dp.buff.Len() > 0 {
+		properties, err := dp.DecodePropertySection(DISCONNECT)
+		if err != nil {
+			return nil, err
+		}
+		dp.Properties = properties
+	}
 	return dp, nil
 }
 
 func (dp *DisconnectPacket) Encode() ([]byte, error) {
+	if dp.ReasonCode != NormalDisconnection || len(dp.Properties) > 0 {
+		if err := dp.EncodeByte(dp.ReasonCode); err != nil {
+			return nil, err
+		}
+	}
+	if len(dp.Properties) > 0 {
+		if err := dp.EncodePropertySection(DISCONNECT, dp.Properties); err != nil {
+			return nil, err
+		}
+	}
 	return dp.EncodeFixedHeader()
 }
+
+// Disconnect builds a server initiated DISCONNECT, only MQTT 5 clients may be sent one.
+func Disconnect(rc byte) *DisconnectPacket {
+	return &DisconnectPacket{
+		Packet: Packet{
+			Type: DISCONNECT,
+			buff: &bytes.Buffer{},
+		},
+		ReasonCode: rc,
+	}
+}
+
+// DisconnectWithReason builds a server initiated DISCONNECT explaining the reason code with a reason string.
+func DisconnectWithReason(rc byte, reason string) *DisconnectPacket {
+	dp := Disconnect(rc)
+	dp.Properties.Add(ReasonStringIdentifier, reason)
+	return dp
+}
+
+// MoveServer builds a DISCONNECT sending the client to another server,
+// temporarily with UseAnotherServer or permanently with ServerMoved.
+func MoveServer(rc byte, serverReference string) *DisconnectPacket {
+	dp := Disconnect(rc)
+	dp.Properties.Add(ServerReferenceIdentifier, serverReference)
+	return dp
+}
@@ -0,0 +1,60 @@
+package packets
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDisconnectRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		dp   *DisconnectPacket
+		want []byte
+	}{
+		{
+			name: "normal disconnection",
+			dp:   Disconnect(NormalDisconnection),
+			want: []byte{0xE0, 0},
+		},
+		{
+			name: "disconnect with will",
+			dp:   Disconnect(DisconnectWithWill),
+			want: []byte{0xE0, 1, 0x04},
+		},
+		{
+			name: "reason string",
+			dp:   DisconnectWithReason(AdministrativeAction, "bye"),
+			want: []byte{0xE0, 8, 0x98, 6, 0x1F, 0, 3, 'b', 'y', 'e'},
+		},
+		{
+			name: "server reference",
+			dp:   MoveServer(ServerMoved, "b:1883"),
+			want: []byte{0xE0, 11, 0x9D, 9, 0x1C, 0, 6, 'b', ':', '1', '8', '8', '3'},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dp.SetVersion(MQTT5)
+			b, err := tt.dp.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tt.want) {
+				t.Fatalf("Encode() = %v, want %v", b, tt.want)
+			}
+
+			p, err := NewMQTTPacket(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := NewDisconnectPacket(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ReasonCode != tt.dp.ReasonCode || !reflect.DeepEqual(got.Properties, tt.dp.Properties) {
+				t.Errorf("NewDisconnectPacket() = %d %v, want %d %v", got.ReasonCode, got.Properties, tt.dp.ReasonCode, tt.dp.Properties)
+			}
+		})
+	}
+}
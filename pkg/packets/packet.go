@@ -47,9 +47,27 @@ type StringPair struct {
 	value string
 }
 
+func NewStringPair(name string, value string) StringPair {
+	return StringPair{name: name, value: value}
+}
+
+func (sp StringPair) Name() string {
+	return sp.name
+}
+
+func (sp StringPair) Value() string {
+	return sp.value
+}
+
+// SetVersion sets the protocol level the packet is encoded with.
+func (p *Packet) SetVersion(version byte) {
+	p.Version = version
+}
+
 func (pi *PacketIdentifier) DecodePacketIdentifier() error {
-	pi.PacketIdentifier = pi.DecodeTwoByteInt()
-	return nil
+	var err error
+	pi.PacketIdentifier, err = pi.DecodeTwoByteInt()
+	return err
 }
 
 func (pi *PacketIdentifier) EncodePacketIdentifier() error {
@@ -68,6 +86,8 @@ type Packet struct {
 	Flags          FixedHeaderFlags
 	RemaningLength int
 	buff           *bytes.Buffer
+	// Protocol level the packet is encoded with, MQTT 5 packets carry properties.
+	Version byte
 }
 
 // Gets how many bytes the remaining length has taken
@@ -83,30 +103,83 @@ func (p *Packet) RemainingLengthByteLength() int {
 	}
 }
 
+// Largest remaining length a variable byte integer can hold.
+const MaxRemainingLength = 268435455
+
+var (
+	ErrMalformedPacket = errors.New("Malformed packet")
+	ErrPacketTooLarge  = errors.New("Packet exceeds maximum packet size")
+)
+
+// FromReader reads a single packet from the stream with no size limit beyond
+// the protocol's own.
 func FromReader(reader io.Reader) (*Packet, error) {
-	b := make([]byte, 5)
-	_, err := reader.Read(b) // TOOD Bad Packet Read
+	return ReadPacket(reader, 0)
+}
 
+// ReadPacket reads exactly one packet from the stream, leaving any following
+// packets unread. Packets larger than maxSize bytes, including the fixed
+// header, are rejected with ErrPacketTooLarge, zero disables the limit. A
+// stream that ends before the packet starts returns io.EOF, one that ends
+// part way through returns io.ErrUnexpectedEOF.
+func ReadPacket(reader io.Reader, maxSize int) (*Packet, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return nil, err
+	}
 	Type, Flags := DecodeTypeAndFlags(b[0])
-	rl, err := DecodeVariableByteInteger(b[1:])
+	if Type == Reserved {
+		return nil, ErrMalformedPacket
+	}
 
+	// Remaining length is one to four bytes, the high bit marks a continuation.
+	rl := 0
+	m := 1
+	n := 0
+	for {
+		if n == 4 {
+			return nil, ErrMalformedPacket
+		}
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		rl += int(b[0]&0x7F) * m
+		m *= 128
+		n++
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	if maxSize > 0 && 1+n+rl > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	// The buffer grows as the packet arrives, a remaining length alone
+	// doesn't allocate memory for data that hasn't been sent.
+	buff := &bytes.Buffer{}
+	read, err := buff.ReadFrom(io.LimitReader(reader, int64(rl)))
 	if err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
+	}
+	if read < int64(rl) {
+		return nil, io.ErrUnexpectedEOF
 	}
 
-	p := &Packet{
+	return &Packet{
 		Type:           Type,
 		Flags:          Flags,
 		RemaningLength: rl,
-	}
-
-	offset := 5 - p.RemainingLengthByteLength()
-	buff := make([]byte, p.RemaningLength-offset)
-	// Getting bytes from the start of the
-	buff = append(b[offset:], buff...)
-	p.buff = bytes.NewBuffer(buff)
+		buff:           buff,
+	}, nil
+}
 
-	return p, nil
+// unexpectedEOF reports a stream ending part way through a packet.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 func NewMQTTPacket(b []byte) (*Packet, error) {
@@ -170,17 +243,18 @@ func (p *Packet) DecodeVariableByteInteger() (int, error) {
 		// Reading next byte from bufer.
 		eb, err := p.buff.ReadByte()
 		if err != nil {
-			return 0, err
+			return 0, ErrMalformedPacket
 		}
 		v += (int(eb) & 0x7F) * m
 		m *= 128
-		if m > 128*128*128 {
-			return -1, errors.New("Malformed byte")
-		}
 		n++
 		if eb&0x80 == 0 {
 			break
 		}
+		// Four bytes is the most a variable byte integer can use.
+		if n == 4 {
+			return -1, ErrMalformedPacket
+		}
 	}
 
 	return v, nil
@@ -194,50 +268,93 @@ func DecodeVariableByteInteger(b []byte) (int, error) {
 
 		v += (int(eb) & 0x7F) * m
 		m *= 128
-		if m > 128*128*128 {
-			return -1, errors.New("Malformed byte")
-		}
 		n++
 		if eb&0x80 == 0 {
 			break
 		}
+		// Four bytes is the most a variable byte integer can use.
+		if n == 4 {
+			return -1, ErrMalformedPacket
+		}
 	}
 
 	return v, nil
 }
 
+// The decoding helpers return ErrMalformedPacket if the packet ends before
+// the value does.
+
 func (p *Packet) DecodeByte() (byte, error) {
-	return p.buff.ReadByte()
+	b, err := p.buff.ReadByte()
+	if err != nil {
+		return 0, ErrMalformedPacket
+	}
+	return b, nil
 }
 
-func (p *Packet) DecodeFourByteInt() uint32 {
-	b := p.buff.Next(4)
-	return binary.BigEndian.Uint32(b)
+func (p *Packet) DecodeFourByteInt() (uint32, error) {
+	if p.buff.Len() < 4 {
+		return 0, ErrMalformedPacket
+	}
+	return binary.BigEndian.Uint32(p.buff.Next(4)), nil
 }
 
-func (p *Packet) DecodeTwoByteInt() uint16 {
-	b := p.buff.Next(2)
-	return binary.BigEndian.Uint16(b)
+func (p *Packet) DecodeTwoByteInt() (uint16, error) {
+	if p.buff.Len() < 2 {
+		return 0, ErrMalformedPacket
+	}
+	return binary.BigEndian.Uint16(p.buff.Next(2)), nil
 }
 
-func (p *Packet) DecodeString() string {
-	length := p.DecodeTwoByteInt()
-	b := p.buff.Next(int(length))
-	return string(b)
+func (p *Packet) DecodeString() (string, error) {
+	b, err := p.decodeLengthPrefixed()
+	return string(b), err
 }
 
-func (p *Packet) DecodeBinaryData(length int) []byte {
-	return p.buff.Next(length)
+// DecodeBinaryData reads binary data prefixed with its two byte length.
+func (p *Packet) DecodeBinaryData() ([]byte, error) {
+	b, err := p.decodeLengthPrefixed()
+	if err != nil {
+		return nil, err
+	}
+	// Copied so the data outlives the packet buffer.
+	return append([]byte{}, b...), nil
 }
 
-func (p *Packet) DecodeStringPair() *StringPair {
-	name := p.DecodeString()
-	value := p.DecodeString()
+func (p *Packet) DecodeStringPair() (*StringPair, error) {
+	name, err := p.DecodeString()
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.DecodeString()
+	if err != nil {
+		return nil, err
+	}
 
 	return &StringPair{
 		name:  name,
 		value: value,
+	}, nil
+}
+
+// decodeLengthPrefixed reads data prefixed with its two byte length. The
+// slice is only valid until the buffer is next read.
+func (p *Packet) decodeLengthPrefixed() ([]byte, error) {
+	length, err := p.DecodeTwoByteInt()
+	if err != nil {
+		return nil, err
+	}
+	if p.buff.Len() < int(length) {
+		return nil, ErrMalformedPacket
+	}
+	return p.buff.Next(int(length)), nil
+}
+
+func (p *Packet) EncodeStringPair(sp StringPair) error {
+	if err := p.EncodeString(sp.name); err != nil {
+		return err
 	}
+	return p.EncodeString(sp.value)
 }
 
 func (p *Packet) EncodeVariableByteInteger(x int) error {
@@ -299,7 +416,7 @@ func (p *Packet) EncodeTypeAndFlags() byte {
 	if p.Flags.Duplicate {
 		tf |= 0x08
 	}
-	tf |= p.Flags.QoS << 2
+	tf |= p.Flags.QoS << 1
 	if p.Flags.Retain {
 		tf |= 0x01
 	}
@@ -2,8 +2,10 @@ package packets
 
 import (
 	"bytes"
+	"io"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 func TestNewPacket(t *testing.T) {
@@ -179,6 +181,13 @@ func TestDecodeByte(t *testing.T) {
 			want:    1,
 			wantErr: false,
 		},
+		{
+			name: "Decode past the end",
+			args: args{
+				b: bytes.NewBuffer([]byte{}),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -224,11 +233,24 @@ func TestDecodeFourByteInt(t *testing.T) {
 			want1:   4,
 			wantErr: false,
 		},
+		{
+			name: "Decode a truncated four byte integer",
+			args: args{
+				b: bytes.NewBuffer([]byte{0, 0, 32}),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &Packet{buff: tt.args.b}
-			got := p.DecodeFourByteInt()
+			got, err := p.DecodeFourByteInt()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeFourByteInt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
 			if got != tt.want {
 				t.Errorf("DecodeFourByteInt() got = %v, want %v", got, tt.want)
 			}
@@ -256,11 +278,24 @@ func TestDecodeTwoByteInt(t *testing.T) {
 			want1:   2,
 			wantErr: false,
 		},
+		{
+			name: "Decode a truncated two byte integer",
+			args: args{
+				b: bytes.NewBuffer([]byte{16}),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &Packet{buff: tt.args.b}
-			got := p.DecodeTwoByteInt()
+			got, err := p.DecodeTwoByteInt()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeTwoByteInt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
 			if got != tt.want {
 				t.Errorf("DecodeTwoByteInt() got = %v, want %v", got, tt.want)
 			}
@@ -288,11 +323,24 @@ func TestDecodeBinaryData(t *testing.T) {
 			want1:   6,
 			wantErr: false,
 		},
+		{
+			name: "Decode binary data shorter than its length",
+			args: args{
+				b: bytes.NewBuffer([]byte{0, 4, 2, 3}),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &Packet{buff: tt.args.b}
-			got := p.DecodeBinaryData()
+			got, err := p.DecodeBinaryData()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeBinaryData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("DecodeBinaryData() got = %v, want %v", got, tt.want)
 			}
@@ -303,7 +351,7 @@ func TestDecodeBinaryData(t *testing.T) {
 func TestDecodeStringPair(t *testing.T) {
 	testByteArray := []byte{0, 16}
 	testByteArray = append(testByteArray, []byte("Here is a string")...)
-	testByteArray = append(testByteArray, 0, 23)
+	testByteArray = append(testByteArray, 0, 22)
 	testByteArray = append(testByteArray, []byte("Here is another string")...)
 	type args struct {
 		b *bytes.Buffer
@@ -324,15 +372,28 @@ func TestDecodeStringPair(t *testing.T) {
 				name:  "Here is a string",
 				value: "Here is another string",
 			},
-			want1:   16 + 23 + 4,
+			want1:   16 + 22 + 4,
 			wantErr: false,
 		},
+		{
+			name: "Decode a pair missing its value",
+			args: args{
+				b: bytes.NewBuffer(testByteArray[:18]),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &Packet{buff: tt.args.b}
-			got := p.DecodeStringPair()
-			if got.name != tt.want.name && got.value != tt.want.value {
+			got, err := p.DecodeStringPair()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeStringPair() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.name != tt.want.name || got.value != tt.want.value {
 				t.Errorf("DecodeStringPair() got = %v, want %v", got, tt.want.name)
 			}
 		})
@@ -361,11 +422,24 @@ func TestDecodeString(t *testing.T) {
 			want1:   18,
 			wantErr: false,
 		},
+		{
+			name: "Decode a string missing its length",
+			args: args{
+				b: bytes.NewBuffer([]byte{0}),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &Packet{buff: tt.args.b}
-			got := p.DecodeString()
+			got, err := p.DecodeString()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
 
 			if got != tt.want {
 				t.Errorf("DecodeString() got = %v, want %v", got, tt.want)
@@ -374,3 +448,161 @@ func TestDecodeString(t *testing.T) {
 		})
 	}
 }
+
+func TestSubscriptionOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		options byte
+		wantErr error
+	}{
+		{"QoS 2", MQTT311, 0x02, nil},
+		{"QoS 3", MQTT311, 0x03, ErrMalformedPacket},
+		{"MQTT 3.1.1 reserved bit", MQTT311, 0x04, ErrMalformedPacket},
+		{"MQTT 5 No Local and Retain Handling", MQTT5, 0x25, nil},
+		{"MQTT 5 QoS 3", MQTT5, 0x07, ErrMalformedPacket},
+		{"MQTT 5 Retain Handling 3", MQTT5, 0x31, ErrMalformedPacket},
+		{"MQTT 5 reserved bit", MQTT5, 0x81, ErrMalformedPacket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := []byte{0x82, 6, 0, 1, 0, 1, 'a', tt.options}
+			if tt.version >= MQTT5 {
+				// Empty property section.
+				b = []byte{0x82, 7, 0, 1, 0, 0, 1, 'a', tt.options}
+			}
+			p, err := NewMQTTPacket(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetVersion(tt.version)
+			if _, err := NewSubscribePacket(p); err != tt.wantErr {
+				t.Errorf("NewSubscribePacket() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  []byte
+		maxSize int
+		want    [][]byte
+		wantErr error
+	}{
+		{
+			name:   "concatenated packets",
+			stream: []byte{0xC0, 0, 0x30, 3, 0, 1, 'a', 0xE0, 0},
+			want:   [][]byte{{}, {0, 1, 'a'}, {}},
+		},
+		{
+			name:   "two byte remaining length",
+			stream: append([]byte{0x30, 0x80, 0x01}, make([]byte, 128)...),
+			want:   [][]byte{make([]byte, 128)},
+		},
+		{
+			name:    "too large",
+			stream:  []byte{0x30, 3, 0, 1, 'a'},
+			maxSize: 4,
+			wantErr: ErrPacketTooLarge,
+		},
+		{
+			name:    "at maximum size",
+			stream:  []byte{0x30, 3, 0, 1, 'a'},
+			maxSize: 5,
+			want:    [][]byte{{0, 1, 'a'}},
+		},
+		{
+			name:    "remaining length over four bytes",
+			stream:  []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01},
+			wantErr: ErrMalformedPacket,
+		},
+		{
+			name:    "reserved packet type",
+			stream:  []byte{0x00, 0},
+			wantErr: ErrMalformedPacket,
+		},
+		{
+			name:    "empty stream",
+			wantErr: io.EOF,
+		},
+		{
+			name:    "truncated payload",
+			stream:  []byte{0x30, 3, 0, 1},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "maximum remaining length without the payload",
+			stream:  []byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F, 0, 1},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "truncated remaining length",
+			stream:  []byte{0x30, 0x80},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Bytes arrive one at a time, as if split across TCP segments.
+			r := iotest.OneByteReader(bytes.NewReader(tt.stream))
+			for _, want := range tt.want {
+				p, err := ReadPacket(r, tt.maxSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := p.buff.Bytes(); !bytes.Equal(got, want) || p.RemaningLength != len(want) {
+					t.Errorf("ReadPacket() body = %v, want %v", got, want)
+				}
+			}
+			_, err := ReadPacket(r, tt.maxSize)
+			if tt.wantErr == nil {
+				tt.wantErr = io.EOF
+			}
+			if err != tt.wantErr {
+				t.Errorf("ReadPacket() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTruncatedPackets(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      []byte
+		decode func(p *Packet) error
+	}{
+		{"SUBSCRIBE topic filter cut short", []byte{0x82, 3, 0, 1, 0}, func(p *Packet) error {
+			_, err := NewSubscribePacket(p)
+			return err
+		}},
+		{"SUBSCRIBE without options", []byte{0x82, 5, 0, 1, 0, 1, 'a'}, func(p *Packet) error {
+			_, err := NewSubscribePacket(p)
+			return err
+		}},
+		{"PUBLISH topic name cut short", []byte{0x30, 1, 0}, func(p *Packet) error {
+			_, err := NewPublishPacket(p)
+			return err
+		}},
+		{"QoS 1 PUBLISH without packet identifier", []byte{0x32, 3, 0, 1, 'a'}, func(p *Packet) error {
+			_, err := NewPublishPacket(p)
+			return err
+		}},
+		{"PUBACK packet identifier cut short", []byte{0x40, 1, 0}, func(p *Packet) error {
+			_, err := NewPublishQoSPacket(p)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewMQTTPacket(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.decode(p); err != ErrMalformedPacket {
+				t.Errorf("decoding error = %v, want %v", err, ErrMalformedPacket)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package packets
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Property Identifiers, MQTT 5 only.
+const (
+	PayloadFormatIndicatorIdentifier          = 0x01 //Payload Format Indicator
+	MessageExpiryIntervalIdentifier           = 0x02 //Message Expiry Interval
+	ContentTypeIdentifier                     = 0x03 //Content Type
+	ResponseTopicIdentifier                   = 0x08 //Response Topic
+	CorrelationDataIdentifier                 = 0x09 //Correlation Data
+	SubscriptionIdentifierIdentifier          = 0x0B //Subscription Identifier
+	SessionExpiryIntervalIdentifier           = 0x11 //Session Expiry Interval
+	AssignedClientIdentifierIdentifier        = 0x12 //Assigned Client Identifier
+	ServerKeepAliveIdentifier                 = 0x13 //Server Keep Alive
+	AuthenticationMethodIdentifier            = 0x15 //Authentication Method
+	AuthenticationDataIdentifier              = 0x16 //Authentication Data
+	RequestProblemInformationIdentifier       = 0x17 //Request Problem Information
+	WillDelayIntervalIdentifier               = 0x18 //Will Delay Interval
+	RequestResponseInformationIdentifier      = 0x19 //Request Response Information
+	ResponseInformationIdentifier             = 0x1A //Response Information
+	ServerReferenceIdentifier                 = 0x1C //Server Reference
+	ReasonStringIdentifier                    = 0x1F //Reason String
+	ReceiveMaximumIdentifier                  = 0x21 //Receive Maximum
+	TopicAliasMaximumIdentifier               = 0x22 //Topic Alias Maximum
+	TopicAliasIdentifier                      = 0x23 //Topic Alias
+	MaximumQoSIdentifier                      = 0x24 //Maximum QoS
+	RetainAvailableIdentifier                 = 0x25 //Retain Available
+	UserPropertyIdentifier                    = 0x26 //User Property
+	MaximumPacketSizeIdentifier               = 0x27 //Maximum Packet Size
+	WildcardSubscriptionAvailableIdentifier   = 0x28 //Wildcard Subscription Available
+	SubscriptionIdentifierAvailableIdentifier = 0x29 //Subscription Identifier Available
+	SharedSubscriptionAvailableIdentifier     = 0x2A //Shared Subscription Available
+)
+
+// Will properties are validated as if the will was a packet of its own.
+const willProperties = 16
+
+var (
+	ErrInvalidProperty      = errors.New("Invalid property identifier")
+	ErrPropertyNotAllowed   = errors.New("Property not allowed in packet")
+	ErrDuplicateProperty    = errors.New("Property included more than once")
+	ErrInvalidPropertyValue = errors.New("Invalid property value")
+)
+
+type propertyType byte
+
+const (
+	byteProperty propertyType = iota
+	twoByteIntProperty
+	fourByteIntProperty
+	variableByteIntProperty
+	stringProperty
+	stringPairProperty
+	binaryProperty
+)
+
+type propertyDefinition struct {
+	kind propertyType
+	// Packet types the property can be sent in.
+	packets []byte
+	// Byte properties that can only be zero or one.
+	boolean bool
+	// Properties where zero is a protocol error.
+	nonZero bool
+}
+
+var propertyDefinitions = map[byte]propertyDefinition{
+	PayloadFormatIndicatorIdentifier:          {kind: byteProperty, packets: []byte{PUBLISH, willProperties}, boolean: true},
+	MessageExpiryIntervalIdentifier:           {kind: fourByteIntProperty, packets: []byte{PUBLISH, willProperties}},
+	ContentTypeIdentifier:                     {kind: stringProperty, packets: []byte{PUBLISH, willProperties}},
+	ResponseTopicIdentifier:                   {kind: stringProperty, packets: []byte{PUBLISH, willProperties}},
+	CorrelationDataIdentifier:                 {kind: binaryProperty, packets: []byte{PUBLISH, willProperties}},
+	SubscriptionIdentifierIdentifier:          {kind: variableByteIntProperty, packets: []byte{PUBLISH, SUBSCRIBE}, nonZero: true},
+	SessionExpiryIntervalIdentifier:           {kind: fourByteIntProperty, packets: []byte{CONNECT, CONNACK, DISCONNECT}},
+	AssignedClientIdentifierIdentifier:        {kind: stringProperty, packets: []byte{CONNACK}},
+	ServerKeepAliveIdentifier:                 {kind: twoByteIntProperty, packets: []byte{CONNACK}},
+	AuthenticationMethodIdentifier:            {kind: stringProperty, packets: []byte{CONNECT, CONNACK, AUTH}},
+	AuthenticationDataIdentifier:              {kind: binaryProperty, packets: []byte{CONNECT, CONNACK, AUTH}},
+	RequestProblemInformationIdentifier:       {kind: byteProperty, packets: []byte{CONNECT}, boolean: true},
+	WillDelayIntervalIdentifier:               {kind: fourByteIntProperty, packets: []byte{willProperties}},
+	RequestResponseInformationIdentifier:      {kind: byteProperty, packets: []byte{CONNECT}, boolean: true},
+	ResponseInformationIdentifier:             {kind: stringProperty, packets: []byte{CONNACK}},
+	ServerReferenceIdentifier:                 {kind: stringProperty, packets: []byte{CONNACK, DISCONNECT}},
+	ReasonStringIdentifier:                    {kind: stringProperty, packets: []byte{CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK, DISCONNECT, AUTH}},
+	ReceiveMaximumIdentifier:                  {kind: twoByteIntProperty, packets: []byte{CONNECT, CONNACK}, nonZero: true},
+	TopicAliasMaximumIdentifier:               {kind: twoByteIntProperty, packets: []byte{CONNECT, CONNACK}},
+	TopicAliasIdentifier:                      {kind: twoByteIntProperty, packets: []byte{PUBLISH}, nonZero: true},
+	MaximumQoSIdentifier:                      {kind: byteProperty, packets: []byte{CONNACK}, boolean: true},
+	RetainAvailableIdentifier:                 {kind: byteProperty, packets: []byte{CONNACK}, boolean: true},
+	UserPropertyIdentifier:                    {kind: stringPairProperty, packets: []byte{CONNECT, CONNACK, PUBLISH, willProperties, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK, DISCONNECT, AUTH}},
+	MaximumPacketSizeIdentifier:               {kind: fourByteIntProperty, packets: []byte{CONNECT, CONNACK}, nonZero: true},
+	WildcardSubscriptionAvailableIdentifier:   {kind: byteProperty, packets: []byte{CONNACK}, boolean: true},
+	SubscriptionIdentifierAvailableIdentifier: {kind: byteProperty, packets: []byte{CONNACK}, boolean: true},
+	SharedSubscriptionAvailableIdentifier:     {kind: byteProperty, packets: []byte{CONNACK}, boolean: true},
+}
+
+// allowed reports whether the property can be sent in the packet type.
+func (pd propertyDefinition) allowed(packetType byte) bool {
+	for _, t := range pd.packets {
+		if t == packetType {
+			return true
+		}
+	}
+	return false
+}
+
+// repeatable reports whether the property can appear more than once in the packet type.
+func repeatable(identifier byte, packetType byte) bool {
+	return identifier == UserPropertyIdentifier ||
+		(identifier == SubscriptionIdentifierIdentifier && packetType == PUBLISH)
+}
+
+// Property is a single MQTT 5 property. Value is a byte, uint16, uint32,
+// int for variable byte integers, string, StringPair or []byte depending on
+// the property identifier.
+type Property struct {
+	Identifier byte
+	Value      interface{}
+}
+
+// Properties are kept in the order they were decoded or added, user
+// properties must keep their order.
+type Properties []Property
+
+// Get returns the value of the first property with the identifier.
+func (ps Properties) Get(identifier byte) (interface{}, bool) {
+	for _, p := range ps {
+		if p.Identifier == identifier {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Byte returns a byte property, or false if it wasn't sent.
+func (ps Properties) Byte(identifier byte) (byte, bool) {
+	v, ok := ps.Get(identifier)
+	b, isByte := v.(byte)
+	return b, ok && isByte
+}
+
+// Uint16 returns a two byte integer property, or false if it wasn't sent.
+func (ps Properties) Uint16(identifier byte) (uint16, bool) {
+	v, ok := ps.Get(identifier)
+	i, isUint16 := v.(uint16)
+	return i, ok && isUint16
+}
+
+// Uint32 returns a four byte integer property, or false if it wasn't sent.
+func (ps Properties) Uint32(identifier byte) (uint32, bool) {
+	v, ok := ps.Get(identifier)
+	i, isUint32 := v.(uint32)
+	return i, ok && isUint32
+}
+
+// String returns a UTF-8 string property, or false if it wasn't sent.
+func (ps Properties) String(identifier byte) (string, bool) {
+	v, ok := ps.Get(identifier)
+	s, isString := v.(string)
+	return s, ok && isString
+}
+
+// Binary returns a binary data property, or false if it wasn't sent.
+func (ps Properties) Binary(identifier byte) ([]byte, bool) {
+	v, ok := ps.Get(identifier)
+	b, isBinary := v.([]byte)
+	return b, ok && isBinary
+}
+
+// SubscriptionIdentifiers returns every subscription identifier in order.
+func (ps Properties) SubscriptionIdentifiers() []int {
+	var ids []int
+	for _, p := range ps {
+		if id, ok := p.Value.(int); ok && p.Identifier == SubscriptionIdentifierIdentifier {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// UserProperties returns every user property in order.
+func (ps Properties) UserProperties() []StringPair {
+	var ups []StringPair
+	for _, p := range ps {
+		if up, ok := p.Value.(StringPair); ok && p.Identifier == UserPropertyIdentifier {
+			ups = append(ups, up)
+		}
+	}
+	return ups
+}
+
+// Add appends a property, keeping any others with the same identifier.
+func (ps *Properties) Add(identifier byte, value interface{}) {
+	*ps = append(*ps, Property{Identifier: identifier, Value: value})
+}
+
+// Set replaces every property with the identifier with a single value.
+func (ps *Properties) Set(identifier byte, value interface{}) {
+	ps.Delete(identifier)
+	ps.Add(identifier, value)
+}
+
+// Delete removes every property with the identifier.
+func (ps *Properties) Delete(identifier byte) {
+	kept := (*ps)[:0]
+	for _, p := range *ps {
+		if p.Identifier != identifier {
+			kept = append(kept, p)
+		}
+	}
+	*ps = kept
+}
+
+// validate checks a property can be sent in the packet type, and that its value is allowed.
+func (p Property) validate(packetType byte) error {
+	pd, ok := propertyDefinitions[p.Identifier]
+	if !ok {
+		return ErrInvalidProperty
+	}
+	if !pd.allowed(packetType) {
+		return ErrPropertyNotAllowed
+	}
+
+	var valid bool
+	switch v := p.Value.(type) {
+	case byte:
+		valid = pd.kind == byteProperty && (!pd.boolean || v <= 1) && (!pd.nonZero || v != 0)
+	case uint16:
+		valid = pd.kind == twoByteIntProperty && (!pd.nonZero || v != 0)
+	case uint32:
+		valid = pd.kind == fourByteIntProperty && (!pd.nonZero || v != 0)
+	case int:
+		valid = pd.kind == variableByteIntProperty && v >= 0 && v <= MaxRemainingLength && (!pd.nonZero || v != 0)
+	case string:
+		valid = pd.kind == stringProperty
+	case StringPair:
+		valid = pd.kind == stringPairProperty
+	case []byte:
+		valid = pd.kind == binaryProperty
+	}
+	if !valid {
+		return ErrInvalidPropertyValue
+	}
+	return nil
+}
+
+// validateProperties checks every property can be sent in the packet type,
+// and that only repeatable properties appear more than once.
+func validateProperties(ps Properties, packetType byte) error {
+	seen := make(map[byte]bool, len(ps))
+	for _, p := range ps {
+		if err := p.validate(packetType); err != nil {
+			return err
+		}
+		if seen[p.Identifier] && !repeatable(p.Identifier, packetType) {
+			return ErrDuplicateProperty
+		}
+		seen[p.Identifier] = true
+	}
+	return nil
+}
+
+// DecodePropertySection reads an MQTT 5 property section, rejecting
+// properties that aren't allowed in the packet type.
+func (p *Packet) DecodePropertySection(packetType byte) (Properties, error) {
+	length, err := p.DecodeVariableByteInteger()
+	if err != nil {
+		return nil, err
+	}
+	if length > p.buff.Len() {
+		return nil, ErrMalformedPacket
+	}
+	section := &Packet{buff: bytes.NewBuffer(p.buff.Next(length))}
+
+	var ps Properties
+	for section.buff.Len() > 0 {
+		identifier, err := section.DecodeVariableByteInteger()
+		if err != nil {
+			return nil, err
+		}
+		pd, ok := propertyDefinitions[byte(identifier)]
+		if !ok || identifier > 0x7F {
+			return nil, ErrInvalidProperty
+		}
+		value, err := section.decodePropertyValue(pd.kind)
+		if err != nil {
+			return nil, err
+		}
+		ps.Add(byte(identifier), value)
+	}
+
+	if err := validateProperties(ps, packetType); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// decodePropertyValue reads a single property value, erroring if it runs past the section.
+func (p *Packet) decodePropertyValue(kind propertyType) (interface{}, error) {
+	switch kind {
+	case byteProperty:
+		return p.DecodeByte()
+	case twoByteIntProperty:
+		return p.DecodeTwoByteInt()
+	case fourByteIntProperty:
+		return p.DecodeFourByteInt()
+	case variableByteIntProperty:
+		return p.DecodeVariableByteInteger()
+	case stringProperty:
+		return p.DecodeString()
+	case binaryProperty:
+		return p.DecodeBinaryData()
+	default:
+		sp, err := p.DecodeStringPair()
+		if err != nil {
+			return nil, err
+		}
+		return *sp, nil
+	}
+}
+
+// EncodePropertySection writes an MQTT 5 property section prefixed with its
+// length, rejecting properties that aren't allowed in the packet type.
+func (p *Packet) EncodePropertySection(packetType byte, ps Properties) error {
+	if err := validateProperties(ps, packetType); err != nil {
+		return err
+	}
+
+	section := &Packet{buff: &bytes.Buffer{}}
+	for _, property := range ps {
+		if err := section.EncodeVariableByteInteger(int(property.Identifier)); err != nil {
+			return err
+		}
+		var err error
+		switch v := property.Value.(type) {
+		case byte:
+			err = section.EncodeByte(v)
+		case uint16:
+			err = section.EncodeTwoByteInt(v)
+		case uint32:
+			err = section.EncodeFourByteInt(v)
+		case int:
+			err = section.EncodeVariableByteInteger(v)
+		case string:
+			err = section.EncodeString(v)
+		case StringPair:
+			err = section.EncodeStringPair(v)
+		case []byte:
+			err = section.EncodeBinary(v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := p.EncodeVariableByteInteger(section.buff.Len()); err != nil {
+		return err
+	}
+	_, err := p.Write(section.buff.Bytes())
+	return err
+}
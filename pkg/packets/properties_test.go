@@ -0,0 +1,230 @@
+package packets
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPropertySectionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		packetType byte
+		properties Properties
+	}{
+		{
+			name:       "every value type",
+			packetType: PUBLISH,
+			properties: Properties{
+				{PayloadFormatIndicatorIdentifier, byte(1)},
+				{TopicAliasIdentifier, uint16(7)},
+				{MessageExpiryIntervalIdentifier, uint32(3600)},
+				{SubscriptionIdentifierIdentifier, 268435455},
+				{ContentTypeIdentifier, "application/json"},
+				{UserPropertyIdentifier, NewStringPair("site", "a")},
+				{CorrelationDataIdentifier, []byte{0, 1, 2}},
+			},
+		},
+		{
+			name:       "repeated user properties keep their order",
+			packetType: DISCONNECT,
+			properties: Properties{
+				{UserPropertyIdentifier, NewStringPair("k", "2")},
+				{ReasonStringIdentifier, "shutting down"},
+				{UserPropertyIdentifier, NewStringPair("k", "1")},
+			},
+		},
+		{
+			name:       "repeated subscription identifiers in PUBLISH",
+			packetType: PUBLISH,
+			properties: Properties{
+				{SubscriptionIdentifierIdentifier, 1},
+				{SubscriptionIdentifierIdentifier, 200},
+			},
+		},
+		{
+			name:       "empty",
+			packetType: SUBACK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Packet{buff: &bytes.Buffer{}}
+			if err := p.EncodePropertySection(tt.packetType, tt.properties); err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.DecodePropertySection(tt.packetType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.properties) {
+				t.Errorf("DecodePropertySection() = %v, want %v", got, tt.properties)
+			}
+			if p.buff.Len() != 0 {
+				t.Errorf("%d bytes left after the property section", p.buff.Len())
+			}
+		})
+	}
+}
+
+func TestDecodePropertySectionErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		packetType byte
+		section    []byte
+		wantErr    error
+	}{
+		{"unknown identifier", PUBLISH, []byte{2, 0x7F, 0}, ErrInvalidProperty},
+		{"not allowed in packet", PUBLISH, []byte{3, ServerKeepAliveIdentifier, 0, 10}, ErrPropertyNotAllowed},
+		{"will property in CONNECT", CONNECT, []byte{5, WillDelayIntervalIdentifier, 0, 0, 0, 1}, ErrPropertyNotAllowed},
+		{"duplicate", CONNACK, []byte{6, ServerKeepAliveIdentifier, 0, 10, ServerKeepAliveIdentifier, 0, 20}, ErrDuplicateProperty},
+		{"repeated subscription identifier in SUBSCRIBE", SUBSCRIBE, []byte{4, SubscriptionIdentifierIdentifier, 1, SubscriptionIdentifierIdentifier, 2}, ErrDuplicateProperty},
+		{"boolean out of range", CONNECT, []byte{2, RequestProblemInformationIdentifier, 2}, ErrInvalidPropertyValue},
+		{"zero receive maximum", CONNECT, []byte{3, ReceiveMaximumIdentifier, 0, 0}, ErrInvalidPropertyValue},
+		{"value runs past section", PUBLISH, []byte{3, MessageExpiryIntervalIdentifier, 0, 0, 0, 1}, ErrMalformedPacket},
+		{"string runs past section", PUBLISH, []byte{4, ContentTypeIdentifier, 0, 5, 'a'}, ErrMalformedPacket},
+		{"section runs past packet", PUBLISH, []byte{9, ContentTypeIdentifier}, ErrMalformedPacket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Packet{buff: bytes.NewBuffer(tt.section)}
+			if _, err := p.DecodePropertySection(tt.packetType); err != tt.wantErr {
+				t.Errorf("DecodePropertySection() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncodePropertySectionRejectsWrongType(t *testing.T) {
+	p := &Packet{buff: &bytes.Buffer{}}
+	err := p.EncodePropertySection(CONNACK, Properties{{ServerKeepAliveIdentifier, uint32(10)}})
+	if err != ErrInvalidPropertyValue {
+		t.Errorf("EncodePropertySection() error = %v, want %v", err, ErrInvalidPropertyValue)
+	}
+}
+
+func TestPacketPropertiesRoundTrip(t *testing.T) {
+	userProperties := Properties{{UserPropertyIdentifier, NewStringPair("trace", "abc")}}
+
+	publish := Publish("a/b", []byte("payload"), FixedHeaderFlags{QoS: 1}, 9)
+	publish.Version = MQTT5
+	publish.Properties = Properties{{ContentTypeIdentifier, "text/plain"}, {SubscriptionIdentifierIdentifier, 3}}
+
+	ack := Acknowledge(9)
+	ack.Version = MQTT5
+	ack.ReasonCode = 0x10
+	ack.Properties = Properties{{ReasonStringIdentifier, "no matching subscribers"}}
+
+	subscribe := &SubscribePacket{Properties: Properties{{SubscriptionIdentifierIdentifier, 3}}, Topics: []Topic{{Topic: "a/+", QoS: 1}}}
+	subscribe.Version = MQTT5
+	subscribe.PacketIdentifier.PacketIdentifier = 4
+
+	unsubAck := UnsubAck(4, []byte{UnsubscribeSuccess})
+	unsubAck.Version = MQTT5
+	unsubAck.Properties = userProperties
+
+	disconnect := Disconnect(NormalDisconnection)
+	disconnect.Properties = Properties{{SessionExpiryIntervalIdentifier, uint32(0)}}
+
+	connack := Accepted(true)
+	connack.Version = MQTT5
+	connack.Properties = Properties{{ServerKeepAliveIdentifier, uint16(30)}, {AssignedClientIdentifierIdentifier, "auto-1"}}
+
+	tests := []struct {
+		name   string
+		packet interface{ Encode() ([]byte, error) }
+		decode func(*Packet) (Properties, error)
+	}{
+		{"PUBLISH", publish, func(p *Packet) (Properties, error) {
+			pp, err := NewPublishPacket(p)
+			if err != nil {
+				return nil, err
+			}
+			if pp.TopicName != "a/b" || pp.PacketIdentifier != 9 || string(pp.Payload) != "payload" {
+				t.Errorf("NewPublishPacket() = %+v", pp)
+			}
+			return pp.Properties, nil
+		}},
+		{"PUBACK", ack, func(p *Packet) (Properties, error) {
+			pqp, err := NewPublishQoSPacket(p)
+			if err != nil {
+				return nil, err
+			}
+			if pqp.ReasonCode != 0x10 {
+				t.Errorf("ReasonCode = %x, want 0x10", pqp.ReasonCode)
+			}
+			return pqp.Properties, nil
+		}},
+		{"SUBSCRIBE", subscribe, func(p *Packet) (Properties, error) {
+			sp, err := NewSubscribePacket(p)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(sp.Topics, subscribe.Topics) {
+				t.Errorf("Topics = %v, want %v", sp.Topics, subscribe.Topics)
+			}
+			return sp.Properties, nil
+		}},
+		{"UNSUBACK", unsubAck, func(p *Packet) (Properties, error) {
+			uap, err := NewUnsubAckPacket(p)
+			if err != nil {
+				return nil, err
+			}
+			return uap.Properties, nil
+		}},
+		{"DISCONNECT", disconnect, func(p *Packet) (Properties, error) {
+			dp, err := NewDisconnectPacket(p)
+			if err != nil {
+				return nil, err
+			}
+			return dp.Properties, nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.packet.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := NewMQTTPacket(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Version = MQTT5
+			got, err := tt.decode(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := reflect.ValueOf(tt.packet).Elem().FieldByName("Properties").Interface()
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Properties = %v, want %v", got, want)
+			}
+		})
+	}
+
+	t.Run("CONNACK", func(t *testing.T) {
+		b, err := connack.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := NewConnackPacket(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.SessionPresent != 1 || !reflect.DeepEqual(got.Properties, connack.Properties) {
+			t.Errorf("NewConnackPacket() = %+v, want %+v", got, connack)
+		}
+	})
+}
+
+func TestSuccessAckOmitsReasonCode(t *testing.T) {
+	ack := Acknowledge(9)
+	ack.Version = MQTT5
+	b, err := ack.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x40, 2, 0, 9}; !bytes.Equal(b, want) {
+		t.Errorf("Encode() = %v, want %v", b, want)
+	}
+}
@@ -8,22 +8,42 @@ type PublishPacket struct {
 	Packet
 	TopicName        string
 	PacketIdentifier uint16
+	Properties       Properties
 	Payload          []byte
 }
 
 type PublishQoSPacket struct {
 	Packet
 	PacketIdentifier
+
+	// MQTT 5 only, both can be left out when the reason code is success.
+	ReasonCode byte
+	Properties Properties
 }
 
 func NewPublishQoSPacket(p *Packet) (*PublishQoSPacket, error) {
+	// Both embedded packets share the same buffer.
 	pqp := &PublishQoSPacket{
 		Packet: *p,
+		PacketIdentifier: PacketIdentifier{
+			Packet: *p,
+		},
 	}
 	err := pqp.DecodePacketIdentifier()
 	if err != nil {
 		return nil, err
 	}
+
+	if pqp.Version >= MQTT5 && pqp.Packet.buff.Len() > 0 {
+		if pqp.ReasonCode, err = pqp.Packet.DecodeByte(); err != nil {
+			return nil, err
+		}
+		if pqp.Packet.buff.Len() > 0 {
+			if pqp.Properties, err = pqp.Packet.DecodePropertySection(pqp.Type); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return pqp, nil
 }
 
@@ -44,13 +64,20 @@ func NewPublishPacket(p *Packet) (*PublishPacket, error) {
 		}
 	}
 
+	if pp.Version >= MQTT5 {
+		if pp.Properties, err = pp.DecodePropertySection(PUBLISH); err != nil {
+			return nil, err
+		}
+	}
+
 	pp.Payload = pp.buff.Next(pp.buff.Len())
 	return pp, nil
 }
 
 func (pp *PublishPacket) DecodeTopicName() error {
-	pp.TopicName = pp.DecodeString()
-	return nil
+	var err error
+	pp.TopicName, err = pp.DecodeString()
+	return err
 }
 
 func (pp *PublishPacket) EncodeTopicName() error {
@@ -59,10 +86,11 @@ func (pp *PublishPacket) EncodeTopicName() error {
 }
 
 func (pp *PublishPacket) DecodePacketIdentifier() error {
+	var err error
 	if pp.Flags.QoS > 0 {
-		pp.PacketIdentifier = pp.DecodeTwoByteInt()
+		pp.PacketIdentifier, err = pp.DecodeTwoByteInt()
 	}
-	return nil
+	return err
 }
 
 func (pp *PublishPacket) EncodePacketIdentifier() error {
@@ -73,6 +101,9 @@ func (pp *PublishPacket) EncodePacketIdentifier() error {
 }
 
 func (pp *PublishPacket) Encode() ([]byte, error) {
+	// Encoding into a fresh buffer so a packet can be encoded again for retransmission.
+	pp.buff = &bytes.Buffer{}
+
 	// Variable header starts with the topic name
 	if err := pp.EncodeTopicName(); err != nil {
 		return nil, err
@@ -85,15 +116,51 @@ func (pp *PublishPacket) Encode() ([]byte, error) {
 		}
 	}
 
-	pp.EncodeBinary(pp.Payload)
+	if pp.Version >= MQTT5 {
+		if err := pp.EncodePropertySection(PUBLISH, pp.Properties); err != nil {
+			return nil, err
+		}
+	}
+
+	// Payload takes up the rest of the packet, it has no length prefix.
+	if _, err := pp.Write(pp.Payload); err != nil {
+		return nil, err
+	}
 	return pp.EncodeFixedHeader()
 }
 
 func (pq *PublishQoSPacket) Encode() ([]byte, error) {
+	pq.Packet.buff = &bytes.Buffer{}
 	pq.EncodeTwoByteInt(pq.PacketIdentifier.PacketIdentifier)
+
+	// Success with no properties is just the packet identifier.
+	if pq.Version >= MQTT5 && (pq.ReasonCode != 0 || len(pq.Properties) > 0) {
+		if err := pq.EncodeByte(pq.ReasonCode); err != nil {
+			return nil, err
+		}
+		if len(pq.Properties) > 0 {
+			if err := pq.EncodePropertySection(pq.Type, pq.Properties); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return pq.EncodeFixedHeader()
 }
 
+// Publish builds an outbound PUBLISH, the packet identifier is only encoded for QoS > 0.
+func Publish(topic string, payload []byte, flags FixedHeaderFlags, i uint16) *PublishPacket {
+	return &PublishPacket{
+		Packet: Packet{
+			Type:  PUBLISH,
+			Flags: flags,
+			buff:  &bytes.Buffer{},
+		},
+		TopicName:        topic,
+		PacketIdentifier: i,
+		Payload:          payload,
+	}
+}
+
 func Acknowledge(i uint16) *PublishQoSPacket {
 	return &PublishQoSPacket{
 		Packet: Packet{
@@ -122,10 +189,26 @@ func Received(i uint16) *PublishQoSPacket {
 	}
 }
 
+func Release(i uint16) *PublishQoSPacket {
+	return &PublishQoSPacket{
+		Packet: Packet{
+			Type: PUBREL,
+			// Reserved fixed header flags for PUBREL are 0010.
+			Flags:          FixedHeaderFlags{QoS: 1},
+			RemaningLength: 2,
+			buff:           &bytes.Buffer{},
+		},
+		// This is a bit ridiculous
+		PacketIdentifier: PacketIdentifier{
+			PacketIdentifier: i,
+		},
+	}
+}
+
 func Complete(i uint16) *PublishQoSPacket {
 	return &PublishQoSPacket{
 		Packet: Packet{
-			Type:           6,
+			Type:           PUBCOMP,
 			RemaningLength: 2,
 			buff:           &bytes.Buffer{},
 		},
@@ -0,0 +1,136 @@
+package packets
+
+// Reason Code Values, MQTT 5 only. Codes below 0x80 report success, the
+// rest report failure. Each packet only allows some of them.
+const (
+	Success                             = 0x00 //Success, also Normal disconnection and Granted QoS 0
+	NormalDisconnection                 = 0x00 //Close the connection normally
+	DisconnectWithWill                  = 0x04 //The Client wishes to disconnect but requires that the Server also publishes its Will Message
+	NoMatchingSubscribers               = 0x10 //The message is accepted but there are no subscribers
+	NoSubscriptionExisted               = 0x11 //No matching Topic Filter is being used by the Client
+	ContinueAuthentication              = 0x18 //Continue the authentication with another step
+	ReAuthenticate                      = 0x19 //Initiate a re-authentication
+	UnspecifiedError                    = 0x80 //The Server does not wish to reveal the reason for the failure, or none of the other Reason Codes apply
+	MalformedPacket                     = 0x81 //Data within the packet could not be correctly parsed
+	ProtocolError                       = 0x82 //Data in the packet does not conform to this specification
+	ImplementationSpecificError         = 0x83 //The packet is valid but is not accepted by this Server
+	UnsupportedProtocolVersion          = 0x84 //The Server does not support the version of the MQTT protocol requested by the Client
+	ClientIdentifierNotValid            = 0x85 //The Client Identifier is a valid string but is not allowed by the Server
+	BadUsernameOrPasswordV5             = 0x86 //The Server does not accept the User Name or Password specified by the Client
+	NotAuthorized                       = 0x87 //The Client is not authorized to perform the operation
+	ServerUnavailableV5                 = 0x88 //The MQTT Server is not available
+	ServerBusy                          = 0x89 //The Server is busy, try again later
+	Banned                              = 0x8A //This Client has been banned by administrative action
+	ServerShuttingDown                  = 0x8B //The Server is shutting down
+	BadAuthenticationMethod             = 0x8C //The authentication method is not supported or does not match the authentication method currently in use
+	KeepAliveTimeout                    = 0x8D //The Connection is closed because no packet has been received for 1.5 times the Keepalive time
+	SessionTakenOver                    = 0x8E //Another Connection using the same ClientID has connected
+	TopicFilterInvalid                  = 0x8F //The Topic Filter is correctly formed but is not accepted by this Server
+	TopicNameInvalid                    = 0x90 //The Topic Name is correctly formed but is not accepted by this Server
+	PacketIdentifierInUse               = 0x91 //The Packet Identifier is already in use
+	PacketIdentifierNotFound            = 0x92 //The Packet Identifier is not known
+	ReceiveMaximumExceeded              = 0x93 //The Client or Server has received more than Receive Maximum publications it has not sent PUBACK or PUBCOMP for
+	TopicAliasInvalid                   = 0x94 //The Topic Alias is not valid
+	PacketTooLarge                      = 0x95 //The packet size is greater than Maximum Packet Size
+	MessageRateTooHigh                  = 0x96 //The received data rate is too high
+	QuotaExceeded                       = 0x97 //An implementation or administrative imposed limit has been exceeded
+	AdministrativeAction                = 0x98 //The Connection is closed due to an administrative action
+	PayloadFormatInvalid                = 0x99 //The payload format does not match the Payload Format Indicator
+	RetainNotSupported                  = 0x9A //The Server does not support retained messages
+	QoSNotSupported                     = 0x9B //The Client specified a QoS greater than the Maximum QoS
+	UseAnotherServer                    = 0x9C //The Client should temporarily use another server
+	ServerMoved                         = 0x9D //The Client should permanently use another server
+	SharedSubscriptionsNotSupported     = 0x9E //The Server does not support Shared Subscriptions
+	ConnectionRateExceeded              = 0x9F //This connection is closed because the connection rate is too high
+	MaximumConnectTime                  = 0xA0 //The maximum connection time authorized for this connection has been exceeded
+	SubscriptionIdentifiersNotSupported = 0xA1 //The Server does not support Subscription Identifiers
+	WildcardSubscriptionsNotSupported   = 0xA2 //The Server does not support Wildcard Subscriptions
+)
+
+var reasonStrings = map[byte]string{
+	Success:                             "Success",
+	0x01:                                "Granted QoS 1",
+	0x02:                                "Granted QoS 2",
+	DisconnectWithWill:                  "Disconnect with Will Message",
+	NoMatchingSubscribers:               "No matching subscribers",
+	NoSubscriptionExisted:               "No subscription existed",
+	ContinueAuthentication:              "Continue authentication",
+	ReAuthenticate:                      "Re-authenticate",
+	UnspecifiedError:                    "Unspecified error",
+	MalformedPacket:                     "Malformed Packet",
+	ProtocolError:                       "Protocol Error",
+	ImplementationSpecificError:         "Implementation specific error",
+	UnsupportedProtocolVersion:          "Unsupported Protocol Version",
+	ClientIdentifierNotValid:            "Client Identifier not valid",
+	BadUsernameOrPasswordV5:             "Bad User Name or Password",
+	NotAuthorized:                       "Not authorized",
+	ServerUnavailableV5:                 "Server unavailable",
+	ServerBusy:                          "Server busy",
+	Banned:                              "Banned",
+	ServerShuttingDown:                  "Server shutting down",
+	BadAuthenticationMethod:             "Bad authentication method",
+	KeepAliveTimeout:                    "Keep Alive timeout",
+	SessionTakenOver:                    "Session taken over",
+	TopicFilterInvalid:                  "Topic Filter invalid",
+	TopicNameInvalid:                    "Topic Name invalid",
+	PacketIdentifierInUse:               "Packet Identifier in use",
+	PacketIdentifierNotFound:            "Packet Identifier not found",
+	ReceiveMaximumExceeded:              "Receive Maximum exceeded",
+	TopicAliasInvalid:                   "Topic Alias invalid",
+	PacketTooLarge:                      "Packet too large",
+	MessageRateTooHigh:                  "Message rate too high",
+	QuotaExceeded:                       "Quota exceeded",
+	AdministrativeAction:                "Administrative action",
+	PayloadFormatInvalid:                "Payload format invalid",
+	RetainNotSupported:                  "Retain not supported",
+	QoSNotSupported:                     "QoS not supported",
+	UseAnotherServer:                    "Use another server",
+	ServerMoved:                         "Server moved",
+	SharedSubscriptionsNotSupported:     "Shared Subscriptions not supported",
+	ConnectionRateExceeded:              "Connection rate exceeded",
+	MaximumConnectTime:                  "Maximum connect time",
+	SubscriptionIdentifiersNotSupported: "Subscription Identifiers not supported",
+	WildcardSubscriptionsNotSupported:   "Wildcard Subscriptions not supported",
+}
+
+// ReasonString returns the specification's description of a reason code.
+func ReasonString(rc byte) string {
+	if s, ok := reasonStrings[rc]; ok {
+		return s
+	}
+	return "Unknown reason code"
+}
+
+// Failed reports whether a reason code reports failure.
+func Failed(rc byte) bool {
+	return rc >= UnspecifiedError
+}
+
+// CONNACK return codes from 3.1.1 and their MQTT 5 reason codes.
+var connackReasonCodes = map[byte]byte{
+	UnnaceptableProtocolVersion: UnsupportedProtocolVersion,
+	IdentifierRejected:          ClientIdentifierNotValid,
+	ServerUnavailable:           ServerUnavailableV5,
+	BadUsernameOrPassword:       BadUsernameOrPasswordV5,
+	NotAuthorised:               NotAuthorized,
+}
+
+// connackReturnCode converts a CONNACK code to the protocol version's
+// layout. MQTT 5 failures without a 3.1.1 equivalent become server unavailable.
+func connackReturnCode(rc byte, version byte) byte {
+	if version >= MQTT5 {
+		if v5, ok := connackReasonCodes[rc]; ok {
+			return v5
+		}
+		return rc
+	}
+	if !Failed(rc) {
+		return rc
+	}
+	for v3, v5 := range connackReasonCodes {
+		if v5 == rc {
+			return v3
+		}
+	}
+	return ServerUnavailable
+}
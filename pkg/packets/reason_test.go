@@ -0,0 +1,59 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConnackReturnCodeDialects(t *testing.T) {
+	tests := []struct {
+		name    string
+		connack ConnackPacket
+		version byte
+		want    byte
+	}{
+		{"3.1.1 bad credentials", BadAuth(), MQTT311, BadUsernameOrPassword},
+		{"MQTT 5 bad credentials", BadAuth(), MQTT5, BadUsernameOrPasswordV5},
+		{"MQTT 5 not authorized", NotAuth(), MQTT5, NotAuthorized},
+		{"MQTT 5 accepted", Accepted(false), MQTT5, ConnectionAccepted},
+		{"MQTT 5 only code for 3.1.1", ConnackPacket{Packet: Packet{Type: CONNACK, buff: &bytes.Buffer{}}, ReturnCode: Banned}, MQTT311, ServerUnavailable},
+		{"MQTT 5 code for 3.1.1 with an equivalent", ConnackPacket{Packet: Packet{Type: CONNACK, buff: &bytes.Buffer{}}, ReturnCode: NotAuthorized}, MQTT311, NotAuthorised},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.connack.SetVersion(tt.version)
+			b, err := tt.connack.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b[3] != tt.want {
+				t.Errorf("return code = %#x, want %#x", b[3], tt.want)
+			}
+		})
+	}
+}
+
+func TestSubAckFailureCodes(t *testing.T) {
+	rcs := []byte{SubscribeMaximumQoS1, TopicFilterInvalid, NotAuthorized}
+	tests := []struct {
+		name    string
+		version byte
+		want    []byte
+	}{
+		{"MQTT 3.1.1", MQTT311, []byte{0x90, 5, 0, 1, SubscribeMaximumQoS1, SubscribeFailure, SubscribeFailure}},
+		{"MQTT 5", MQTT5, []byte{0x90, 6, 0, 1, 0, SubscribeMaximumQoS1, TopicFilterInvalid, NotAuthorized}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sa := SubAck(1, rcs)
+			sa.SetVersion(tt.version)
+			got, err := sa.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Encode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package packets
 
 import (
 	"bytes"
+	"errors"
 )
 
 type Topic struct {
@@ -11,14 +12,24 @@ type Topic struct {
 
 type SubscribePacket struct {
 	PacketIdentifier
+	Properties Properties
 
 	//Payload Properties
 	Topics []Topic
 }
 
+// Subscribe Return Code Values
+const (
+	SubscribeMaximumQoS0 = 0x00 //Success - Maximum QoS 0
+	SubscribeMaximumQoS1 = 0x01 //Success - Maximum QoS 1
+	SubscribeMaximumQoS2 = 0x02 //Success - Maximum QoS 2
+	SubscribeFailure     = 0x80 //Failure, MQTT 5 clients are sent the reason instead
+)
+
 type SubAckPacket struct {
 	PacketIdentifier
-	ReturnCode byte
+	Properties  Properties
+	ReturnCodes []byte
 }
 
 func NewSubAckPacket(p *Packet) (*SubAckPacket, error) {
@@ -31,7 +42,12 @@ func NewSubAckPacket(p *Packet) (*SubAckPacket, error) {
 	if err != nil {
 		return nil, err
 	}
-	sap.ReturnCode, err = sap.DecodeByte()
+	if sap.Version >= MQTT5 {
+		if sap.Properties, err = sap.DecodePropertySection(SUBACK); err != nil {
+			return nil, err
+		}
+	}
+	sap.ReturnCodes = sap.buff.Next(sap.buff.Len())
 	return sap, nil
 
 }
@@ -42,35 +58,62 @@ func NewSubscribePacket(p *Packet) (*SubscribePacket, error) {
 			Packet: *p,
 		},
 	}
-	err := sp.DecodePacketIdentifier()
-	if err = sp.DecodeTopics(); err != nil {
+	if err := sp.DecodePacketIdentifier(); err != nil {
+		return nil, err
+	}
+	if sp.Version >= MQTT5 {
+		properties, err := sp.DecodePropertySection(SUBSCRIBE)
+		if err != nil {
+			return nil, err
+		}
+		sp.Properties = properties
+	}
+	if err := sp.DecodeTopics(); err != nil {
 		return nil, err
 	}
 	return sp, nil
 }
 
 func (sp *SubscribePacket) DecodeTopics() error {
-	var i int
-	topicsLen := sp.Packet.RemaningLength - 2
-	// Reconsider this.
-	for i < topicsLen {
-
-		length := sp.DecodeTwoByteInt()
-		b := sp.buff.Next(int(length))
-
-		topic := string(b)
-		qos, err := sp.DecodeByte()
+	// Topic filters run to the end of the packet.
+	for sp.buff.Len() > 0 {
+		topic, err := sp.DecodeString()
 		if err != nil {
 			return err
 		}
+		options, err := sp.DecodeByte()
+		if err != nil {
+			return err
+		}
+		if err := sp.checkOptions(options); err != nil {
+			return err
+		}
 		sp.Topics = append(sp.Topics, Topic{
 			Topic: topic,
-			QoS:   qos,
+			QoS:   options & 0x03,
 		})
-		i += int(length + 1)
+	}
 
+	if len(sp.Topics) == 0 {
+		return errors.New("Subscribe packet contains no topic filters")
 	}
+	return nil
+}
 
+// checkOptions rejects subscription options with a QoS of 3 or reserved bits
+// set. MQTT 5 uses bits 2 to 5 for No Local, Retain As Published and Retain
+// Handling, where a Retain Handling of 3 is also invalid.
+func (sp *SubscribePacket) checkOptions(options byte) error {
+	reserved := byte(0xFC)
+	if sp.Version >= MQTT5 {
+		reserved = 0xC0
+		if options&0x30 == 0x30 {
+			return ErrMalformedPacket
+		}
+	}
+	if options&0x03 == 0x03 || options&reserved != 0 {
+		return ErrMalformedPacket
+	}
 	return nil
 }
 
@@ -89,20 +132,27 @@ func (sp *SubscribePacket) EncodeTopics() error {
 }
 
 func (sp *SubscribePacket) Encode() ([]byte, error) {
+	// Reserved fixed header flags for SUBSCRIBE are 0010.
+	sp.Type = SUBSCRIBE
+	sp.Flags = FixedHeaderFlags{QoS: 1}
+	sp.buff = &bytes.Buffer{}
 
 	// Packet identifier
 	if err := sp.EncodePacketIdentifier(); err != nil {
 		return nil, err
 	}
 
+	if sp.Version >= MQTT5 {
+		if err := sp.EncodePropertySection(SUBSCRIBE, sp.Properties); err != nil {
+			return nil, err
+		}
+	}
+
 	// Encode the topics
 	if err := sp.EncodeTopics(); err != nil {
 		return nil, err
 	}
 
-	// Encode the QoS byte.
-	sp.EncodeByte(sp.Flags.QoS)
-
 	return sp.EncodeFixedHeader()
 }
 
@@ -111,23 +161,40 @@ func (sp *SubAckPacket) Encode() ([]byte, error) {
 		return nil, err
 	}
 
-	if err := sp.EncodeByte(sp.ReturnCode); err != nil {
+	returnCodes := sp.ReturnCodes
+	if sp.Version >= MQTT5 {
+		if err := sp.EncodePropertySection(SUBACK, sp.Properties); err != nil {
+			return nil, err
+		}
+	} else {
+		// Before MQTT 5 every failure has the same return code.
+		returnCodes = make([]byte, len(sp.ReturnCodes))
+		for i, rc := range sp.ReturnCodes {
+			returnCodes[i] = rc
+			if Failed(rc) {
+				returnCodes[i] = SubscribeFailure
+			}
+		}
+	}
+
+	if _, err := sp.Write(returnCodes); err != nil {
 		return nil, err
 	}
 
 	return sp.EncodeFixedHeader()
 }
 
-func SubAck(packetIdentifier uint16, rc byte) *SubAckPacket {
+func SubAck(packetIdentifier uint16, rcs []byte) *SubAckPacket {
 	p := &Packet{
 		buff:           &bytes.Buffer{},
 		Type:           SUBACK,
-		RemaningLength: 3,
+		RemaningLength: 2 + len(rcs),
 	}
 	return &SubAckPacket{
 		PacketIdentifier: PacketIdentifier{
 			Packet:           *p,
 			PacketIdentifier: packetIdentifier,
 		},
+		ReturnCodes: rcs,
 	}
 }
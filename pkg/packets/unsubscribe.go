@@ -1,17 +1,122 @@
 package packets
 
+import (
+	"bytes"
+	"errors"
+)
+
+// Unsubscribe Reason Code Values, MQTT 5 only.
+const (
+	UnsubscribeSuccess             = 0x00 //The subscription is deleted
+	UnsubscribeUnspecifiedError    = 0x80 //The unsubscribe could not be completed
+	UnsubscribeNotAuthorized       = 0x87 //The Client is not authorized to unsubscribe
+	UnsubscribeTopicFilterInvalid  = 0x8F //The Topic Filter is correctly formed but is not allowed
+	UnsubscribePacketIdentifierUse = 0x91 //The specified Packet Identifier is already in use
+)
+
+type UnsubscribePacket struct {
+	PacketIdentifier
+	Properties Properties
+
+	//Payload Properties
+	Topics []string
+}
+
 type UnsubAckPacket struct {
-	*Packet
 	PacketIdentifier
+	Properties Properties
+
+	// One per topic filter in the UNSUBSCRIBE, only encoded for MQTT 5.
+	ReasonCodes []byte
+}
+
+func NewUnsubscribePacket(p *Packet) (*UnsubscribePacket, error) {
+	up := &UnsubscribePacket{
+		PacketIdentifier: PacketIdentifier{
+			Packet: *p,
+		},
+	}
+	if err := up.DecodePacketIdentifier(); err != nil {
+		return nil, err
+	}
+	if up.Version >= MQTT5 {
+		properties, err := up.DecodePropertySection(UNSUBSCRIBE)
+		if err != nil {
+			return nil, err
+		}
+		up.Properties = properties
+	}
+	if err := up.DecodeTopics(); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+func (up *UnsubscribePacket) DecodeTopics() error {
+	// Topic filters run to the end of the packet.
+	for up.buff.Len() > 0 {
+		topic, err := up.DecodeString()
+		if err != nil {
+			return err
+		}
+		up.Topics = append(up.Topics, topic)
+	}
+
+	if len(up.Topics) == 0 {
+		return errors.New("Unsubscribe packet contains no topic filters")
+	}
+	return nil
 }
 
-func NewUnsubAckPacket(p *Packet, b []byte) (*UnsubAckPacket, error) {
+func (up *UnsubscribePacket) EncodeTopics() error {
+	for _, topic := range up.Topics {
+		if err := up.EncodeString(topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (up *UnsubscribePacket) Encode() ([]byte, error) {
+	// Reserved fixed header flags for UNSUBSCRIBE are 0010.
+	up.Type = UNSUBSCRIBE
+	up.Flags = FixedHeaderFlags{QoS: 1}
+	up.buff = &bytes.Buffer{}
+
+	if err := up.EncodePacketIdentifier(); err != nil {
+		return nil, err
+	}
+
+	if up.Version >= MQTT5 {
+		if err := up.EncodePropertySection(UNSUBSCRIBE, up.Properties); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := up.EncodeTopics(); err != nil {
+		return nil, err
+	}
+
+	return up.EncodeFixedHeader()
+}
+
+func NewUnsubAckPacket(p *Packet) (*UnsubAckPacket, error) {
 	usap := &UnsubAckPacket{
-		Packet: p,
+		PacketIdentifier: PacketIdentifier{
+			Packet: *p,
+		},
 	}
 	if err := usap.DecodePacketIdentifier(); err != nil {
 		return nil, err
 	}
+	if usap.Version >= MQTT5 {
+		properties, err := usap.DecodePropertySection(UNSUBACK)
+		if err != nil {
+			return nil, err
+		}
+		usap.Properties = properties
+	}
+	usap.ReasonCodes = usap.buff.Next(usap.buff.Len())
 	return usap, nil
 }
 
@@ -19,5 +124,29 @@ func (uap *UnsubAckPacket) Encode() ([]byte, error) {
 	if err := uap.EncodePacketIdentifier(); err != nil {
 		return nil, err
 	}
+	// Reason codes were introduced in MQTT 5, earlier UNSUBACKs are just the packet identifier.
+	if uap.Version >= MQTT5 {
+		if err := uap.EncodePropertySection(UNSUBACK, uap.Properties); err != nil {
+			return nil, err
+		}
+		if _, err := uap.Write(uap.ReasonCodes); err != nil {
+			return nil, err
+		}
+	}
 	return uap.EncodeFixedHeader()
 }
+
+func UnsubAck(packetIdentifier uint16, rcs []byte) *UnsubAckPacket {
+	p := &Packet{
+		buff:           &bytes.Buffer{},
+		Type:           UNSUBACK,
+		RemaningLength: 2 + len(rcs),
+	}
+	return &UnsubAckPacket{
+		PacketIdentifier: PacketIdentifier{
+			Packet:           *p,
+			PacketIdentifier: packetIdentifier,
+		},
+		ReasonCodes: rcs,
+	}
+}
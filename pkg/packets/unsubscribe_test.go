@@ -0,0 +1,94 @@
+package packets
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestUnsubscribeRoundTrip(t *testing.T) {
+	up := &UnsubscribePacket{
+		PacketIdentifier: PacketIdentifier{PacketIdentifier: 10},
+		Topics:           []string{"site/+/telemetry", "site/#"},
+	}
+	b, err := up.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if b[0] != 0xA2 {
+		t.Errorf("Encode() fixed header = %#x, want 0xa2", b[0])
+	}
+
+	p, err := NewMQTTPacket(b)
+	if err != nil {
+		t.Fatalf("NewMQTTPacket() error = %v", err)
+	}
+	got, err := NewUnsubscribePacket(p)
+	if err != nil {
+		t.Fatalf("NewUnsubscribePacket() error = %v", err)
+	}
+	if got.PacketIdentifier.PacketIdentifier != 10 {
+		t.Errorf("PacketIdentifier = %d, want 10", got.PacketIdentifier.PacketIdentifier)
+	}
+	if !reflect.DeepEqual(got.Topics, up.Topics) {
+		t.Errorf("Topics = %v, want %v", got.Topics, up.Topics)
+	}
+}
+
+func TestUnsubscribeTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"packet identifier cut short", []byte{0xA2, 1, 0}},
+		{"topic filter length cut short", []byte{0xA2, 3, 0, 1, 0}},
+		{"topic filter cut short", []byte{0xA2, 5, 0, 1, 0, 4, 'a'}},
+		{"second topic filter cut short", []byte{0xA2, 8, 0, 1, 0, 1, 'a', 0, 2, 'b'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewMQTTPacket(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewUnsubscribePacket(p); err != ErrMalformedPacket {
+				t.Errorf("NewUnsubscribePacket() error = %v, want %v", err, ErrMalformedPacket)
+			}
+		})
+	}
+}
+
+func TestUnsubAckEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		rcs     []byte
+		want    []byte
+	}{
+		{
+			name:    "MQTT 3.1.1 drops reason codes",
+			version: MQTT311,
+			rcs:     []byte{UnsubscribeSuccess},
+			want:    []byte{0xB0, 2, 0, 7},
+		},
+		{
+			name:    "MQTT 5 reason codes",
+			version: MQTT5,
+			rcs:     []byte{UnsubscribeSuccess, NoSubscriptionExisted},
+			want:    []byte{0xB0, 5, 0, 7, 0, 0x00, 0x11},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua := UnsubAck(7, tt.rcs)
+			ua.SetVersion(tt.version)
+			got, err := ua.Encode()
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Encode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"log"
+	"strings"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+	"github.com/naspinall/Hive-MQTT/pkg/topics"
+)
+
+// Action is what a client wants to do with a topic, rules can allow several at once.
+type Action byte
+
+const (
+	PublishAction      Action = 1 << iota //Publish to a topic name
+	SubscribeAction                       //Subscribe with a topic filter
+	RetainedReadAction                    //Receive a topic's retained message when subscribing
+)
+
+// Authorizer decides whether a client may act on a topic. It returns nil
+// to allow, ErrNotAuthorised to deny, or ErrNoDecision to leave it to the
+// next in Authorizers. Any other error denies the action.
+type Authorizer interface {
+	Authorize(c *Connection, action Action, topic string) error
+}
+
+// authorize checks an action against the client's own rules, then the
+// broker's Authorizer. Actions neither decides on are denied, unless there
+// are no rules at all.
+func (mqtt *MQTT) authorize(c *Connection, action Action, topic string) error {
+	if c.Superuser || c.ACL == nil && mqtt.Authorizer == nil {
+		return nil
+	}
+	err := ErrNoDecision
+	if c.ACL != nil {
+		err = c.ACL.Authorize(c, action, topic)
+	}
+	if err == ErrNoDecision && mqtt.Authorizer != nil {
+		err = mqtt.Authorizer.Authorize(c, action, topic)
+	}
+	switch err {
+	case nil:
+		return nil
+	case ErrNotAuthorised, ErrNoDecision:
+	default:
+		log.Println(err)
+	}
+	return ErrNotAuthorised
+}
+
+// Authorizers asks each authorizer in turn until one decides.
+type Authorizers []Authorizer
+
+func (as Authorizers) Authorize(c *Connection, action Action, topic string) error {
+	for _, authorizer := range as {
+		if err := authorizer.Authorize(c, action, topic); err != ErrNoDecision {
+			return err
+		}
+	}
+	return ErrNoDecision
+}
+
+// ACLRule allows or denies actions on the topics matching its filter.
+type ACLRule struct {
+	// Clients the rule applies to, empty matches every client.
+	Username string
+	ClientID string
+	// Topic filter, %u and %c are replaced with the client's username and ClientID.
+	Topic   string
+	Actions Action
+	Deny    bool
+}
+
+// ACL authorizes clients with an ordered list of rules, the first rule
+// matching the client, action and topic decides. Subscriptions are only
+// allowed by rules covering the whole filter, and denied by any rule whose
+// filter overlaps it, so a client can't subscribe to # and receive topics
+// a later rule would deny.
+type ACL []ACLRule
+
+func (acl ACL) Authorize(c *Connection, action Action, topic string) error {
+	for _, rule := range acl {
+		if rule.Actions&action == 0 {
+			continue
+		}
+		if rule.Username != "" && rule.Username != c.Username || rule.ClientID != "" && rule.ClientID != c.ClientID {
+			continue
+		}
+		filter, ok := substitute(rule.Topic, c)
+		if !ok || !rule.applies(action, filter, topic) {
+			continue
+		}
+		if rule.Deny {
+			return ErrNotAuthorised
+		}
+		return nil
+	}
+	return ErrNoDecision
+}
+
+// applies reports whether the rule's filter decides on the topic.
+func (rule ACLRule) applies(action Action, filter, topic string) bool {
+	if action != SubscribeAction {
+		return topics.Match(filter, topic)
+	}
+	if rule.Deny {
+		return topics.Overlap(filter, topic)
+	}
+	return topics.Covers(filter, topic)
+}
+
+// substitute replaces %u and %c in a rule's filter. Rules naming an
+// identifier the client doesn't have, or one that would add levels or
+// wildcards to the filter, don't apply.
+func substitute(filter string, c *Connection) (string, bool) {
+	for _, identifier := range []struct{ placeholder, value string }{{"%u", c.Username}, {"%c", c.ClientID}} {
+		if !strings.Contains(filter, identifier.placeholder) {
+			continue
+		}
+		if identifier.value == "" || strings.ContainsAny(identifier.value, topics.Separator+topics.SingleLevel+topics.MultiLevel) {
+			return "", false
+		}
+	}
+	// Replaced in one pass, so a username containing %c isn't substituted again.
+	return strings.NewReplacer("%u", c.Username, "%c", c.ClientID).Replace(filter), true
+}
+
+// AuthorizeWill refuses a client whose will publishes to a topic it
+// couldn't publish to itself, or to one that isn't a valid topic name.
+func (mqtt *MQTT) AuthorizeWill(cp *packets.ConnectPacket, c *Connection) error {
+	if !cp.WillFlag {
+		return nil
+	}
+	if !topics.ValidName(cp.WillTopic) {
+		// Older clients have no return code for it, their connection is just closed.
+		if cp.ProtocolVersion < packets.MQTT5 {
+			return ErrTopicNameInvalid
+		}
+		return &ConnackError{ReturnCode: packets.TopicNameInvalid, Err: ErrTopicNameInvalid}
+	}
+	if err := mqtt.authorize(c, PublishAction, cp.WillTopic); err != nil {
+		return &ConnackError{ReturnCode: packets.NotAuthorised, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+func TestACL(t *testing.T) {
+	tenants := ACL{
+		{Topic: "tenants/+/secret", Actions: SubscribeAction, Deny: true},
+		{Username: "admin", Topic: "#", Actions: SubscribeAction},
+		{Topic: "tenants/%u/#", Actions: PublishAction | SubscribeAction},
+		{Topic: "devices/%c/commands", Actions: SubscribeAction},
+	}
+	tests := []struct {
+		name     string
+		username string
+		clientID string
+		action   Action
+		topic    string
+		want     error
+	}{
+		{"publish to own tenant", "alice", "a1", PublishAction, "tenants/alice/status", nil},
+		{"publish to other tenant", "alice", "a1", PublishAction, "tenants/bob/status", ErrNoDecision},
+		{"subscribe within own tenant", "alice", "a1", SubscribeAction, "tenants/alice/+/status", nil},
+		{"subscribe to everything", "alice", "a1", SubscribeAction, "#", ErrNotAuthorised},
+		{"subscribe across tenants", "alice", "a1", SubscribeAction, "tenants/+/status", ErrNoDecision},
+		{"deny overlapping a wide filter", "admin", "console", SubscribeAction, "#", ErrNotAuthorised},
+		{"admin subscribes elsewhere", "admin", "console", SubscribeAction, "devices/#", nil},
+		{"client ID substitution", "", "d7", SubscribeAction, "devices/d7/commands", nil},
+		{"anonymous client has no tenant", "", "d7", PublishAction, "tenants//status", ErrNoDecision},
+		{"wildcard username isn't substituted", "+", "a1", PublishAction, "tenants/bob/status", ErrNoDecision},
+		{"action not granted", "alice", "a1", RetainedReadAction, "tenants/alice/status", ErrNoDecision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Connection{ClientID: tt.clientID, Username: tt.username}
+			if err := tenants.Authorize(c, tt.action, tt.topic); err != tt.want {
+				t.Errorf("Authorize() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func tenantBroker() *MQTT {
+	mqtt := testBroker()
+	mqtt.RetainService = memoryRetain{}
+	mqtt.Authorizer = ACL{
+		{Topic: "tenants/%u/#", Actions: PublishAction | SubscribeAction | RetainedReadAction},
+		{Topic: "tenants/+/shared", Actions: SubscribeAction},
+	}
+	return mqtt
+}
+
+func TestAuthorizationReasonCodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     byte
+		wantSubAck  []byte
+		wantPubAck  []byte
+		wantAllowed []byte
+	}{
+		{
+			name:        "MQTT 5",
+			version:     packets.MQTT5,
+			wantSubAck:  []byte{0x90, 5, 0, 2, 0, 1, packets.NotAuthorized},
+			wantPubAck:  []byte{0x40, 3, 0, 5, packets.NotAuthorized},
+			wantAllowed: []byte{0x40, 3, 0, 6, packets.NoMatchingSubscribers},
+		},
+		{
+			name:        "MQTT 3.1.1",
+			version:     packets.MQTT311,
+			wantSubAck:  []byte{0x90, 4, 0, 2, 1, 0x80},
+			wantPubAck:  []byte{0x40, 2, 0, 5},
+			wantAllowed: []byte{0x40, 2, 0, 6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := tenantBroker()
+			c, client := pipeConnection("a1")
+			c.ProtocolVersion = tt.version
+			c.Username = "alice"
+			c.NoProblemInformation = true
+
+			sp := &packets.SubscribePacket{Topics: []packets.Topic{{Topic: "tenants/alice/inbox", QoS: 1}, {Topic: "#", QoS: 1}}}
+			sp.PacketIdentifier.PacketIdentifier = 2
+			go mqtt.HandleSubscribe(sp, c)
+			expectBytes(t, client, tt.wantSubAck)
+			if got := mqtt.Subscriptions.Count(); got != 1 {
+				t.Errorf("subscriptions = %d, want 1", got)
+			}
+
+			go mqtt.ReceivePublish(packets.Publish("tenants/bob/status", nil, packets.FixedHeaderFlags{QoS: 1}, 5), c)
+			expectBytes(t, client, tt.wantPubAck)
+			go mqtt.ReceivePublish(packets.Publish("tenants/alice/status", nil, packets.FixedHeaderFlags{QoS: 1}, 6), c)
+			expectBytes(t, client, tt.wantAllowed)
+		})
+	}
+}
+
+func TestRetainedReadAuthorized(t *testing.T) {
+	mqtt := tenantBroker()
+	retained := mqtt.RetainService
+	retained.Set(&models.Retain{Topic: "tenants/bob/shared", Payload: []byte("b")})
+	retained.Set(&models.Retain{Topic: "tenants/alice/shared", Payload: []byte("a")})
+
+	c, client := pipeConnection("a1")
+	c.Username = "alice"
+	sp := &packets.SubscribePacket{Topics: []packets.Topic{{Topic: "tenants/+/shared"}}}
+	sp.PacketIdentifier.PacketIdentifier = 2
+
+	done := make(chan struct{})
+	go func() {
+		mqtt.HandleSubscribe(sp, c)
+		close(done)
+	}()
+	expectBytes(t, client, []byte{0x90, 3, 0, 2, 0})
+	expectBytes(t, client, append([]byte{0x31, 23, 0, 20}, "tenants/alice/shared"+"a"...))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("another tenant's retained message was delivered")
+	}
+}
+
+func TestWillTopicAuthorized(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   byte
+		willTopic string
+		// Nil when the connection is closed without a CONNACK.
+		want []byte
+	}{
+		{"not authorised", packets.MQTT311, "tenants/bob/status", []byte{0x20, 2, 0, packets.NotAuthorised}},
+		{"MQTT 5 wildcard", packets.MQTT5, "tenants/alice/#", []byte{0x20, 3, 0, packets.TopicNameInvalid, 0}},
+		{"MQTT 3.1.1 wildcard", packets.MQTT311, "tenants/alice/#", nil},
+		{"MQTT 3.1.1 empty", packets.MQTT311, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := tenantBroker()
+			mqtt.Authenticator = StaticUsers{"alice": "secret"}
+			server, client := net.Pipe()
+			defer client.Close()
+
+			cp := &packets.ConnectPacket{
+				ProtocolName:    "MQTT",
+				ProtocolVersion: tt.version,
+				CleanStartFlag:  true,
+				ClientID:        "a1",
+				UsernameFlag:    true,
+				Username:        "alice",
+				PasswordFlag:    true,
+				Password:        []byte("secret"),
+				WillFlag:        true,
+				WillTopic:       tt.willTopic,
+				WillPayload:     []byte("offline"),
+			}
+			b, err := cp.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go client.Write(b)
+			go mqtt.HandleNewConn(server)
+
+			if tt.want != nil {
+				expectBytes(t, client, tt.want)
+				return
+			}
+			if n, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("Read() = %d, %v, want connection closed", n, err)
+			}
+		})
+	}
+}
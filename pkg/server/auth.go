@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"log"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+var ErrAuthenticationFailed = errors.New("Authentication failed")
+
+// AuthMechanism is an MQTT 5 enhanced authentication method, such as SCRAM-SHA-256.
+type AuthMechanism interface {
+	// Method is the Authentication Method clients ask for.
+	Method() string
+	// Start begins a new exchange with a client.
+	Start(clientID string) AuthExchange
+}
+
+// AuthExchange is one client's challenge/response exchange. It is used
+// from a single goroutine and not reused once done or failed.
+type AuthExchange interface {
+	// Step takes the client's authentication data and returns the data to send
+	// back, continuing the exchange until done. Errors fail the authentication.
+	Step(data []byte) (response []byte, done bool, err error)
+	// Username the client authenticated as, once the exchange is done.
+	Username() string
+}
+
+// AddAuthMechanism offers a mechanism to clients asking for its method.
+func (mqtt *MQTT) AddAuthMechanism(m AuthMechanism) {
+	if mqtt.AuthMechanisms == nil {
+		mqtt.AuthMechanisms = make(map[string]AuthMechanism)
+	}
+	mqtt.AuthMechanisms[m.Method()] = m
+}
+
+// ConnackError refuses a connection, the client is sent the return code in CONNACK.
+type ConnackError struct {
+	ReturnCode byte
+	Err        error
+}
+
+func (ce *ConnackError) Error() string {
+	return ce.Err.Error()
+}
+
+// EnhancedAuth runs the exchange for a client that connected with an
+// authentication method, returning the data to send in CONNACK. Clients
+// without one are left to the other authentication checks.
+func (mqtt *MQTT) EnhancedAuth(cp *packets.ConnectPacket, c *Connection) ([]byte, error) {
+	if cp.AuthMethod == "" {
+		if cp.AuthData != nil {
+			return nil, &ConnackError{ReturnCode: packets.ProtocolError, Err: errors.New("Authentication data without a method")}
+		}
+		return nil, nil
+	}
+	m, ok := mqtt.AuthMechanisms[cp.AuthMethod]
+	if !ok {
+		return nil, &ConnackError{ReturnCode: packets.BadAuthenticationMethod, Err: errors.New("Unsupported authentication method " + cp.AuthMethod)}
+	}
+
+	exchange := m.Start(cp.ClientID)
+	data := cp.AuthData
+	for {
+		response, done, err := exchange.Step(data)
+		if err != nil {
+			return nil, &ConnackError{ReturnCode: packets.NotAuthorised, Err: err}
+		}
+		if done {
+			c.AuthMethod = cp.AuthMethod
+			c.Username = exchange.Username()
+			return response, nil
+		}
+
+		if err := c.WritePacket(packets.Auth(packets.ContinueAuthentication, cp.AuthMethod, response)); err != nil {
+			return nil, err
+		}
+		// The CONNECT timeout still applies, bounding how long the exchange can take.
+		p, err := packets.ReadPacket(c.Conn, mqtt.MaxPacketSize)
+		if err != nil {
+			return nil, err
+		}
+		p.Version = c.ProtocolVersion
+		if p.Type != packets.AUTH {
+			return nil, &ConnackError{ReturnCode: packets.ProtocolError, Err: errors.New("Expected AUTH during authentication")}
+		}
+		ap, err := packets.NewAuthPacket(p)
+		if err != nil {
+			return nil, &ConnackError{ReturnCode: malformed(err).ReasonCode, Err: err}
+		}
+		if ap.ReasonCode != packets.ContinueAuthentication || ap.Method() != cp.AuthMethod {
+			return nil, &ConnackError{ReturnCode: packets.ProtocolError, Err: errors.New("AUTH does not continue the exchange")}
+		}
+		data = ap.Data()
+	}
+}
+
+// HandleAuth drives re-authentication of a connected client, which must
+// use the method it connected with. The client carries on as normal while
+// the exchange runs, and is disconnected if it fails.
+func (mqtt *MQTT) HandleAuth(ap *packets.AuthPacket, c *Connection) error {
+	if c.AuthMethod == "" || ap.Method() != c.AuthMethod {
+		return &DisconnectError{ReasonCode: packets.ProtocolError, Err: errors.New("AUTH without the connection's authentication method")}
+	}
+
+	switch {
+	case ap.ReasonCode == packets.ReAuthenticate && c.reauth == nil:
+		m, ok := mqtt.AuthMechanisms[c.AuthMethod]
+		if !ok {
+			return &DisconnectError{ReasonCode: packets.BadAuthenticationMethod, Err: errors.New("Authentication method no longer supported")}
+		}
+		c.reauth = m.Start(c.ClientID)
+	case ap.ReasonCode == packets.ContinueAuthentication && c.reauth != nil:
+	default:
+		return &DisconnectError{ReasonCode: packets.ProtocolError, Err: errors.New("AUTH out of sequence")}
+	}
+
+	response, done, err := c.reauth.Step(ap.Data())
+	if err != nil {
+		return &DisconnectError{ReasonCode: packets.NotAuthorized, Err: err}
+	}
+	if !done {
+		return c.WritePacket(packets.Auth(packets.ContinueAuthentication, c.AuthMethod, response))
+	}
+
+	username := c.reauth.Username()
+	c.reauth = nil
+	// Re-authenticating can't change who the client is.
+	if username != c.Username {
+		return &DisconnectError{ReasonCode: packets.NotAuthorized, Err: ErrAuthenticationFailed}
+	}
+	log.Printf("%s re-authenticated", c.ClientID)
+	return c.WritePacket(packets.Auth(packets.Success, c.AuthMethod, response))
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type memoryScram map[string]*models.ScramCredential
+
+func (ms memoryScram) Create(credential *models.ScramCredential) error {
+	ms[credential.Username] = credential
+	return nil
+}
+
+func (ms memoryScram) ByUsername(username string) (*models.ScramCredential, error) {
+	credential, ok := ms[username]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	return credential, nil
+}
+
+func (ms memoryScram) Delete(username string) error {
+	delete(ms, username)
+	return nil
+}
+
+func scramMechanism(t *testing.T, username, password string) *ScramSHA256 {
+	t.Helper()
+	credential, err := models.NewScramCredential(username, password, models.DefaultScramIterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := memoryScram{}
+	credentials.Create(credential)
+	return NewScramSHA256(credentials)
+}
+
+// scramClient plays the client's side of a SCRAM-SHA-256 exchange.
+type scramClient struct {
+	username        string
+	password        string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func (sc *scramClient) first() []byte {
+	sc.clientFirstBare = "n=" + sc.username + ",r=fyko+d2lbbFgONRv9qkxdawL"
+	return []byte("n,," + sc.clientFirstBare)
+}
+
+func (sc *scramClient) final(serverFirst []byte) []byte {
+	attributes, _ := scramAttributes(string(serverFirst))
+	salt, _ := base64.StdEncoding.DecodeString(attributes["s"])
+	sc.saltedPassword = pbkdf2.Key([]byte(sc.password), salt, models.DefaultScramIterations, sha256.Size, sha256.New)
+
+	withoutProof := "c=biws,r=" + attributes["r"]
+	sc.authMessage = sc.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	clientKey := hmacSHA256(sc.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], sc.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))
+}
+
+// verify checks the server's final message proves it holds the user's credential.
+func (sc *scramClient) verify(serverFinal []byte) bool {
+	signature := hmacSHA256(hmacSHA256(sc.saltedPassword, "Server Key"), sc.authMessage)
+	return hmac.Equal(serverFinal, []byte("v="+base64.StdEncoding.EncodeToString(signature)))
+}
+
+// readFrame reads one packet with a single byte remaining length.
+func readFrame(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, header[1])
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+func readAuth(t *testing.T, r io.Reader) *packets.AuthPacket {
+	t.Helper()
+	p, err := packets.NewMQTTPacket(readFrame(t, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != packets.AUTH {
+		t.Fatalf("packet type = %d, want AUTH", p.Type)
+	}
+	p.Version = packets.MQTT5
+	ap, err := packets.NewAuthPacket(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ap
+}
+
+func writeAuth(t *testing.T, w io.Writer, rc byte, data []byte) {
+	t.Helper()
+	ap := packets.Auth(rc, ScramSHA256Method, data)
+	ap.SetVersion(packets.MQTT5)
+	b, err := ap.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Write(b)
+}
+
+func TestScramExchange(t *testing.T) {
+	mechanism := scramMechanism(t, "user", "pencil")
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{"correct password", "user", "pencil", nil},
+		{"wrong password", "user", "pen", ErrAuthenticationFailed},
+		{"unknown user", "nobody", "pencil", ErrAuthenticationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &scramClient{username: tt.username, password: tt.password}
+			exchange := mechanism.Start("device")
+
+			serverFirst, done, err := exchange.Step(client.first())
+			if err != nil || done {
+				t.Fatalf("first Step() = %v, %v", done, err)
+			}
+			serverFinal, done, err := exchange.Step(client.final(serverFirst))
+			if err != tt.wantErr {
+				t.Fatalf("final Step() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !done || !client.verify(serverFinal) {
+				t.Errorf("server final message %q not verified", serverFinal)
+			}
+			if exchange.Username() != tt.username {
+				t.Errorf("Username() = %q, want %q", exchange.Username(), tt.username)
+			}
+		})
+	}
+}
+
+func TestScramRejectsMalformedMessages(t *testing.T) {
+	mechanism := scramMechanism(t, "user", "pencil")
+	tests := []struct {
+		name    string
+		first   string
+		wantErr error
+	}{
+		{"channel binding", "p=tls-unique,,n=user,r=abc", ErrScramChannelBinding},
+		{"authorisation identity", "n,a=admin,n=user,r=abc", ErrScramMessage},
+		{"missing nonce", "n,,n=user", ErrScramMessage},
+		{"bad username escape", "n,,n=us=er,r=abc", ErrScramMessage},
+		{"mandatory extension", "n,,m=ext,n=user,r=abc", ErrScramMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := mechanism.Start("device").Step([]byte(tt.first)); err != tt.wantErr {
+				t.Errorf("Step() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnhancedAuthConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		password string
+		// CONNACK reason code, the exchange is skipped when the method is refused.
+		want byte
+	}{
+		{"SCRAM-SHA-256", ScramSHA256Method, "pencil", packets.Success},
+		{"wrong password", ScramSHA256Method, "pen", packets.NotAuthorized},
+		{"unsupported method", "GS2-KRB5", "pencil", packets.BadAuthenticationMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			mqtt.AddAuthMechanism(scramMechanism(t, "user", "pencil"))
+			server, conn := net.Pipe()
+			defer conn.Close()
+
+			client := &scramClient{username: "user", password: tt.password}
+			cp := &packets.ConnectPacket{
+				ProtocolName:              "MQTT",
+				ProtocolVersion:           packets.MQTT5,
+				CleanStartFlag:            true,
+				RequestProblemInformation: true,
+				ClientID:                  "device",
+				AuthMethod:                tt.method,
+				AuthData:                  client.first(),
+			}
+			b, err := cp.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go conn.Write(b)
+			go mqtt.HandleNewConn(server)
+
+			if tt.want != packets.BadAuthenticationMethod {
+				challenge := readAuth(t, conn)
+				if challenge.ReasonCode != packets.ContinueAuthentication {
+					t.Fatalf("AUTH reason code = %#x, want continue", challenge.ReasonCode)
+				}
+				writeAuth(t, conn, packets.ContinueAuthentication, client.final(challenge.Data()))
+			}
+
+			ca, err := packets.NewConnackPacket(readFrame(t, conn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ca.ReturnCode != tt.want {
+				t.Fatalf("CONNACK reason code = %#x, want %#x", ca.ReturnCode, tt.want)
+			}
+			c, registered := mqtt.Connections.Get("device")
+			if tt.want != packets.Success {
+				if registered {
+					t.Error("refused connection was registered")
+				}
+				return
+			}
+			data, _ := ca.Properties.Binary(packets.AuthenticationDataIdentifier)
+			if !client.verify(data) {
+				t.Errorf("CONNACK authentication data %q not verified", data)
+			}
+			if !registered || c.Username != "user" || c.AuthMethod != ScramSHA256Method {
+				t.Error("connection not registered as the authenticated user")
+			}
+		})
+	}
+}
+
+func TestEnhancedAuthAppliesAccount(t *testing.T) {
+	account := func(enabled bool) Users {
+		return Users{Service: memoryUsers{users: map[string]*models.User{
+			"user": {Username: "user", Enabled: enabled, ACL: []models.UserACL{{Topic: "tenants/%u/#", Publish: true}}},
+		}}}
+	}
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		want          byte
+		// Topic the client may then publish to, empty if it may publish to none.
+		allowed string
+	}{
+		{"account rules", account(true), packets.Success, "tenants/user/status"},
+		{"chained account", Chain{Anonymous{}, account(true)}, packets.Success, "tenants/user/status"},
+		{"disabled account", account(false), packets.NotAuthorized, ""},
+		{"no account", StaticUsers{"other": "secret"}, packets.NotAuthorized, ""},
+		{"authenticator can't look clients up", &JWT{}, packets.Success, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			mqtt.AddAuthMechanism(scramMechanism(t, "user", "pencil"))
+			mqtt.Authenticator = tt.authenticator
+			server, conn := net.Pipe()
+			defer conn.Close()
+
+			client := &scramClient{username: "user", password: "pencil"}
+			cp := &packets.ConnectPacket{
+				ProtocolName:    "MQTT",
+				ProtocolVersion: packets.MQTT5,
+				CleanStartFlag:  true,
+				ClientID:        "device",
+				AuthMethod:      ScramSHA256Method,
+				AuthData:        client.first(),
+			}
+			b, err := cp.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go conn.Write(b)
+			go mqtt.HandleNewConn(server)
+
+			challenge := readAuth(t, conn)
+			writeAuth(t, conn, packets.ContinueAuthentication, client.final(challenge.Data()))
+			ca, err := packets.NewConnackPacket(readFrame(t, conn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ca.ReturnCode != tt.want {
+				t.Fatalf("CONNACK reason code = %#x, want %#x", ca.ReturnCode, tt.want)
+			}
+			c, registered := mqtt.Connections.Get("device")
+			if registered != (tt.want == packets.Success) {
+				t.Fatalf("connection registered = %v", registered)
+			}
+			if !registered {
+				return
+			}
+			if tt.allowed != "" && mqtt.authorize(c, PublishAction, tt.allowed) != nil {
+				t.Errorf("publish to %s denied", tt.allowed)
+			}
+			if mqtt.authorize(c, PublishAction, "tenants/other/status") == nil {
+				t.Error("publish outside the account's rules allowed")
+			}
+		})
+	}
+}
+
+func TestReauthentication(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     []byte
+	}{
+		{"same credentials", "pencil", nil},
+		{"wrong password", "pen", []byte{0xE0, 1, packets.NotAuthorized}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			mqtt.AddAuthMechanism(scramMechanism(t, "user", "pencil"))
+			c, conn := pipeConnection("device")
+			c.ProtocolVersion = packets.MQTT5
+			c.Username = "user"
+			c.AuthMethod = ScramSHA256Method
+			go mqtt.HandleConnection(c)
+			defer conn.Close()
+
+			client := &scramClient{username: "user", password: tt.password}
+			writeAuth(t, conn, packets.ReAuthenticate, client.first())
+			challenge := readAuth(t, conn)
+			writeAuth(t, conn, packets.ContinueAuthentication, client.final(challenge.Data()))
+
+			if tt.want != nil {
+				expectBytes(t, conn, tt.want)
+				return
+			}
+			result := readAuth(t, conn)
+			if result.ReasonCode != packets.Success || !client.verify(result.Data()) {
+				t.Errorf("re-authentication result %#x %q", result.ReasonCode, result.Data())
+			}
+		})
+	}
+}
+
+func TestAuthWithoutMethodIsProtocolError(t *testing.T) {
+	mqtt := testBroker()
+	c, conn := pipeConnection("device")
+	c.ProtocolVersion = packets.MQTT5
+	go mqtt.HandleConnection(c)
+	defer conn.Close()
+
+	writeAuth(t, conn, packets.ReAuthenticate, nil)
+	expectBytes(t, conn, []byte{0xE0, 1, packets.ProtocolError})
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection still open, read error = %v", err)
+	}
+}
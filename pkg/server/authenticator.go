@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+var (
+	// Refuses a client whose username or password is wrong.
+	ErrBadCredentials = errors.New("Bad username or password")
+	// Refuses a client that isn't allowed to connect.
+	ErrNotAuthorised = errors.New("Not authorised")
+	// Leaves the decision to the next authenticator in a Chain.
+	ErrNoDecision = errors.New("No authentication decision")
+)
+
+// ConnectInfo describes the connection a CONNECT arrived on.
+type ConnectInfo struct {
+	RemoteAddr net.Addr
+	// Local address the client connected to, identifying the listener.
+	Listener net.Addr
+	// Handshake state of TLS connections, nil for plain TCP.
+	TLS *tls.ConnectionState
+}
+
+// Identity is who an authenticator decided the client is.
+type Identity struct {
+	// Empty for anonymous clients.
+	Username string
+	// Superusers can use every topic.
+	Superuser bool
+	// The client's own rules, checked before the broker's Authorizer.
+	ACL ACL
+	// When the credentials stop being valid, the client is disconnected
+	// then. Zero if they don't expire.
+	Expires time.Time
+}
+
+// Authenticator decides whether a client may connect. Refusing with
+// ErrBadCredentials or ErrNotAuthorised picks the CONNACK return code, any
+// other error refuses the client with server unavailable.
+type Authenticator interface {
+	Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error)
+}
+
+// IdentityResolver is implemented by authenticators that can look up who
+// a client is once it has proved its username some other way, such as MQTT
+// 5 enhanced authentication. Errors are as for Authenticate.
+type IdentityResolver interface {
+	Identify(username string, info *ConnectInfo) (*Identity, error)
+}
+
+// Authenticate checks a client that hasn't used enhanced authentication,
+// recording who it is on the connection. Without an Authenticator every
+// client is allowed.
+func (mqtt *MQTT) Authenticate(cp *packets.ConnectPacket, c *Connection) error {
+	if mqtt.Authenticator == nil {
+		return nil
+	}
+	return c.setIdentity(mqtt.Authenticator.Authenticate(cp, connectInfo(c)))
+}
+
+// Identify records who a client that used enhanced authentication is, so
+// the Authenticator's account state and rules apply to it too. An
+// Authenticator that can't look clients up leaves it no rules of its own,
+// only what the broker's Authorizer allows.
+func (mqtt *MQTT) Identify(c *Connection) error {
+	if mqtt.Authenticator == nil {
+		return nil
+	}
+	resolver, ok := mqtt.Authenticator.(IdentityResolver)
+	if !ok {
+		c.ACL = ACL{}
+		return nil
+	}
+	return c.setIdentity(resolver.Identify(c.Username, connectInfo(c)))
+}
+
+func connectInfo(c *Connection) *ConnectInfo {
+	info := &ConnectInfo{
+		RemoteAddr: c.Conn.RemoteAddr(),
+		Listener:   c.Conn.LocalAddr(),
+	}
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		info.TLS = &state
+	}
+	return info
+}
+
+// setIdentity records an authenticator's decision on the connection,
+// refusing the client with the matching return code.
+func (c *Connection) setIdentity(identity *Identity, err error) error {
+	switch err {
+	case nil:
+		if identity != nil {
+			c.Username = identity.Username
+			c.Superuser = identity.Superuser
+			c.ACL = identity.ACL
+			c.Expires = identity.Expires
+		}
+		return nil
+	case ErrBadCredentials:
+		return &ConnackError{ReturnCode: packets.BadUsernameOrPassword, Err: err}
+	case ErrNotAuthorised, ErrNoDecision:
+		return &ConnackError{ReturnCode: packets.NotAuthorised, Err: err}
+	}
+	return &ConnackError{ReturnCode: packets.ServerUnavailable, Err: err}
+}
+
+// Anonymous allows clients that connect without a username, leaving the
+// others to the next authenticator.
+type Anonymous struct{}
+
+func (Anonymous) Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error) {
+	if cp.UsernameFlag {
+		return nil, ErrNoDecision
+	}
+	return &Identity{}, nil
+}
+
+// StaticUsers authenticates clients against a fixed set of usernames and
+// passwords. Clients without a username or with an unknown one are left to
+// the next authenticator.
+type StaticUsers map[string]string
+
+func (su StaticUsers) Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error) {
+	if !cp.UsernameFlag {
+		return nil, ErrNoDecision
+	}
+	password, ok := su[cp.Username]
+	if !ok {
+		return nil, ErrNoDecision
+	}
+	// Comparing digests keeps the comparison constant time whatever the lengths.
+	want := sha256.Sum256([]byte(password))
+	got := sha256.Sum256(cp.Password)
+	if !cp.PasswordFlag || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+		return nil, ErrBadCredentials
+	}
+	return &Identity{Username: cp.Username}, nil
+}
+
+func (su StaticUsers) Identify(username string, info *ConnectInfo) (*Identity, error) {
+	if _, ok := su[username]; !ok {
+		return nil, ErrNoDecision
+	}
+	return &Identity{Username: username}, nil
+}
+
+// Chain asks each authenticator in turn until one decides, clients none of
+// them decide on are not authorised.
+type Chain []Authenticator
+
+func (ch Chain) Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error) {
+	for _, authenticator := range ch {
+		identity, err := authenticator.Authenticate(cp, info)
+		if err != ErrNoDecision {
+			return identity, err
+		}
+	}
+	return nil, ErrNotAuthorised
+}
+
+// Identify asks each authenticator that can look clients up in turn.
+func (ch Chain) Identify(username string, info *ConnectInfo) (*Identity, error) {
+	for _, authenticator := range ch {
+		resolver, ok := authenticator.(IdentityResolver)
+		if !ok {
+			continue
+		}
+		identity, err := resolver.Identify(username, info)
+		if err != ErrNoDecision {
+			return identity, err
+		}
+	}
+	return nil, ErrNotAuthorised
+}
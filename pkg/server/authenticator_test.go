@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+func TestAuthenticators(t *testing.T) {
+	static := StaticUsers{"sensor": "secret"}
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		username      string
+		password      string
+		wantUsername  string
+		wantErr       error
+	}{
+		{"anonymous without username", Anonymous{}, "", "", "", nil},
+		{"anonymous with username", Anonymous{}, "sensor", "secret", "", ErrNoDecision},
+		{"static user", static, "sensor", "secret", "sensor", nil},
+		{"static wrong password", static, "sensor", "guess", "", ErrBadCredentials},
+		{"static unknown user", static, "other", "secret", "", ErrNoDecision},
+		{"chain falls through to static", Chain{Anonymous{}, static}, "sensor", "secret", "sensor", nil},
+		{"chain allows anonymous", Chain{Anonymous{}, static}, "", "", "", nil},
+		{"chain stops at a refusal", Chain{static, Anonymous{}}, "sensor", "guess", "", ErrBadCredentials},
+		{"chain without a decision", Chain{static}, "other", "secret", "", ErrNotAuthorised},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp := &packets.ConnectPacket{ClientID: "device"}
+			if tt.username != "" {
+				cp.UsernameFlag, cp.Username = true, tt.username
+				cp.PasswordFlag, cp.Password = true, []byte(tt.password)
+			}
+			identity, err := tt.authenticator.Authenticate(cp, &ConnectInfo{})
+			if err != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && identity.Username != tt.wantUsername {
+				t.Errorf("Username = %q, want %q", identity.Username, tt.wantUsername)
+			}
+		})
+	}
+}
+
+// recordingAuthenticator remembers the connection it was asked about.
+type recordingAuthenticator struct {
+	Authenticator
+	info *ConnectInfo
+}
+
+func (ra *recordingAuthenticator) Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error) {
+	ra.info = info
+	return ra.Authenticator.Authenticate(cp, info)
+}
+
+func TestHandleNewConnAuthenticates(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     byte
+	}{
+		{"allowed", "sensor", "secret", packets.ConnectionAccepted},
+		{"wrong password", "sensor", "guess", packets.BadUsernameOrPassword},
+		{"anonymous", "", "", packets.NotAuthorised},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			authenticator := &recordingAuthenticator{Authenticator: StaticUsers{"sensor": "secret"}}
+			mqtt.Authenticator = authenticator
+			server, client := net.Pipe()
+			defer client.Close()
+
+			cp := &packets.ConnectPacket{
+				ProtocolName:    "MQTT",
+				ProtocolVersion: packets.MQTT311,
+				CleanStartFlag:  true,
+				ClientID:        "device",
+			}
+			if tt.username != "" {
+				cp.UsernameFlag, cp.Username = true, tt.username
+				cp.PasswordFlag, cp.Password = true, []byte(tt.password)
+			}
+			b, err := cp.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go client.Write(b)
+			go mqtt.HandleNewConn(server)
+
+			expectBytes(t, client, []byte{0x20, 2, 0, tt.want})
+			if authenticator.info == nil || authenticator.info.RemoteAddr == nil || authenticator.info.Listener == nil {
+				t.Error("authenticator was not given the connection's addresses")
+			}
+			c, registered := mqtt.Connections.Get("device")
+			if registered != (tt.want == packets.ConnectionAccepted) {
+				t.Fatalf("connection registered = %v", registered)
+			}
+			if registered && c.Username != tt.username {
+				t.Errorf("Username = %q, want %q", c.Username, tt.username)
+			}
+		})
+	}
+}
@@ -1,10 +1,169 @@
 package server
 
 import (
+	"log"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
 )
 
 type Connection struct {
-	ClientID string
-	Conn     net.Conn
+	ClientID        string
+	ProtocolVersion byte
+	// Who the client authenticated as, empty for anonymous clients.
+	Username string
+	// Superusers can use every topic.
+	Superuser bool
+	// Rules the client was given when it authenticated, nil if it has none of its own.
+	ACL ACL
+	// When the client's credentials expire, zero if they don't.
+	Expires time.Time
+	expiry  *time.Timer
+	// MQTT 5 enhanced authentication method, re-authentication must use the same one.
+	AuthMethod string
+	// Re-authentication exchange in progress.
+	reauth AuthExchange
+	// Seconds the client can go without sending a packet, zero disables the check.
+	KeepAlive uint16
+	// MQTT 5 clients can ask for reason strings to be left out of acknowledgements.
+	NoProblemInformation bool
+	Conn                 net.Conn
+	Session              *Session
+	// Published if the connection ends without a DISCONNECT.
+	Will   *models.Will
+	willMu sync.Mutex
+
+	// How long a write can take, zero waits forever. Publishers are held up
+	// while their messages are written, so a stalled client mustn't block them.
+	WriteTimeout time.Duration
+
+	// Publishes to a connection come from other clients' goroutines,
+	// writes are serialised so packets aren't interleaved on the wire.
+	writeMu sync.Mutex
+}
+
+// Write writes to the client, closing the connection if it fails or times
+// out. The client's own goroutine then ends the connection.
+func (c *Connection) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.WriteTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		// Part of a packet may have been written, nothing more can follow it.
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+func (c *Connection) Close() error {
+	return c.Conn.Close()
+}
+
+// TakeWill removes and returns the connection's will, so only one of
+// publishing and discarding it happens.
+func (c *Connection) TakeWill() *models.Will {
+	c.willMu.Lock()
+	defer c.willMu.Unlock()
+	will := c.Will
+	c.Will = nil
+	return will
+}
+
+// DisconnectAtExpiry disconnects the client once its credentials expire.
+func (c *Connection) DisconnectAtExpiry() {
+	if c.Expires.IsZero() {
+		return
+	}
+	c.expiry = time.AfterFunc(time.Until(c.Expires), func() {
+		log.Printf("Credentials of %s expired", c.ClientID)
+		c.Disconnect(packets.DisconnectWithReason(packets.NotAuthorized, "Credentials expired"))
+	})
+}
+
+// ReasonProperties explains a reason code with a reason string, unless
+// it's success or the client asked not to be sent them.
+func (c *Connection) ReasonProperties(rc byte) packets.Properties {
+	if rc == packets.Success || c.NoProblemInformation {
+		return nil
+	}
+	return packets.Properties{{Identifier: packets.ReasonStringIdentifier, Value: packets.ReasonString(rc)}}
+}
+
+type encoder interface {
+	Encode() ([]byte, error)
+	SetVersion(version byte)
+}
+
+// WritePacket encodes a packet in the connection's protocol version and writes it to the connection.
+func (c *Connection) WritePacket(p encoder) error {
+	p.SetVersion(c.ProtocolVersion)
+	b, err := p.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(b)
+	return err
+}
+
+// ConnectionRegistry tracks the live connection of each ClientID.
+type ConnectionRegistry struct {
+	mu          sync.Mutex
+	connections map[string]*Connection
+}
+
+func NewConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{
+		connections: make(map[string]*Connection),
+	}
+}
+
+// Register makes c the live connection for its ClientID, returning the
+// connection it replaced, if any.
+func (cr *ConnectionRegistry) Register(c *Connection) *Connection {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	previous := cr.connections[c.ClientID]
+	cr.connections[c.ClientID] = c
+	return previous
+}
+
+// Remove unregisters c, returning false if another connection has taken
+// over its ClientID.
+func (cr *ConnectionRegistry) Remove(c *Connection) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	current, ok := cr.connections[c.ClientID]
+	if !ok {
+		return true
+	}
+	if current != c {
+		return false
+	}
+	delete(cr.connections, c.ClientID)
+	return true
+}
+
+// Get returns the live connection for a ClientID.
+func (cr *ConnectionRegistry) Get(clientID string) (*Connection, bool) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	c, ok := cr.connections[clientID]
+	return c, ok
+}
+
+// Count returns the number of live connections.
+func (cr *ConnectionRegistry) Count() int {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return len(cr.connections)
 }
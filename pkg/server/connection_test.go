@@ -0,0 +1,199 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+func TestTakeOverKeepsSession(t *testing.T) {
+	mqtt := testBroker()
+	cp := &packets.ConnectPacket{ClientID: "device", ProtocolVersion: packets.MQTT5, SessionExpiryInterval: 60}
+
+	session, _ := mqtt.ResumeSession(cp)
+	old, oldClient := pipeConnection("device")
+	old.ProtocolVersion = packets.MQTT5
+	old.Session = session
+	session.Attach(old)
+	old.Will = &models.Will{ClientID: "device", Topic: "presence/device"}
+	mqtt.Connections.Register(old)
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: session, Filter: "commands/device", QoS: 1})
+
+	// Same ClientID connects again, e.g. after a NAT rebind.
+	c, _ := pipeConnection("device")
+	if previous := mqtt.Connections.Register(c); previous != old {
+		t.Fatal("Register() did not return the existing connection")
+	}
+	resumed, present := mqtt.ResumeSession(cp)
+	if !present || resumed != session {
+		t.Fatal("session was not carried over")
+	}
+	c.Session = resumed
+	resumed.Attach(c)
+
+	done := make(chan struct{})
+	go func() {
+		mqtt.TakeOver(old, present)
+		close(done)
+	}()
+	expectBytes(t, oldClient, []byte{0xE0, 1, packets.SessionTakenOver})
+	<-done
+	if _, err := oldClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("old connection still open, read error = %v", err)
+	}
+
+	// Old connection's teardown must not touch the session it lost.
+	mqtt.CloseConnection(old)
+	if current, _ := mqtt.Connections.Get("device"); current != c {
+		t.Error("old connection teardown unregistered the new connection")
+	}
+	if session.Connection() != c {
+		t.Error("old connection teardown detached the session")
+	}
+	if got := mqtt.Subscriptions.Count(); got != 1 {
+		t.Errorf("subscriptions after takeover = %d, want 1", got)
+	}
+	if old.Will != nil {
+		t.Error("will of the taken over connection was kept")
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		version  byte
+		want     []byte
+	}{
+		{"MQTT 3.1", "MQIsdp", packets.MQTT31, []byte{0x20, 2, 0, packets.ConnectionAccepted}},
+		{"MQTT 3.1.1", "MQTT", packets.MQTT311, []byte{0x20, 2, 0, packets.ConnectionAccepted}},
+		{"MQTT 5", "MQTT", packets.MQTT5, []byte{0x20, 3, 0, packets.ConnectionAccepted, 0}},
+		{"MQTT 3.1 level with MQTT name", "MQTT", packets.MQTT31, []byte{0x20, 2, 0, packets.UnnaceptableProtocolVersion}},
+		{"unknown level", "MQTT", 6, []byte{0x20, 2, 0, packets.UnnaceptableProtocolVersion}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			server, client := net.Pipe()
+			defer client.Close()
+
+			cp := &packets.ConnectPacket{
+				ProtocolName:    tt.protocol,
+				ProtocolVersion: tt.version,
+				CleanStartFlag:  true,
+				ClientID:        "device",
+			}
+			b, err := cp.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go client.Write(b)
+			go mqtt.HandleNewConn(server)
+
+			expectBytes(t, client, tt.want)
+			if tt.want[3] != packets.ConnectionAccepted {
+				if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("rejected connection still open, read error = %v", err)
+				}
+				return
+			}
+			c, ok := mqtt.Connections.Get("device")
+			if !ok || c.ProtocolVersion != tt.version {
+				t.Errorf("connection not registered with protocol version %d", tt.version)
+			}
+		})
+	}
+}
+
+func TestEmptyClientID(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    byte
+		cleanStart bool
+		want       byte
+	}{
+		{"MQTT 3.1.1 clean session", packets.MQTT311, true, packets.ConnectionAccepted},
+		{"MQTT 3.1.1 persistent session", packets.MQTT311, false, packets.IdentifierRejected},
+		{"MQTT 5 clean start", packets.MQTT5, true, packets.Success},
+		{"MQTT 5 resuming", packets.MQTT5, false, packets.Success},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			var assigned []string
+			// Two clients connect without a ClientID, neither takes over the other.
+			for i := 0; i < 2; i++ {
+				server, client := net.Pipe()
+				defer client.Close()
+
+				cp := &packets.ConnectPacket{
+					ProtocolName:    "MQTT",
+					ProtocolVersion: tt.version,
+					CleanStartFlag:  tt.cleanStart,
+				}
+				b, err := cp.Encode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				go client.Write(b)
+				go mqtt.HandleNewConn(server)
+
+				ca, err := packets.NewConnackPacket(readFrame(t, client))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ca.ReturnCode != tt.want {
+					t.Fatalf("CONNACK return code = %#x, want %#x", ca.ReturnCode, tt.want)
+				}
+				if tt.version >= packets.MQTT5 {
+					id, ok := ca.Properties.String(packets.AssignedClientIdentifierIdentifier)
+					if !ok || id == "" {
+						t.Fatal("CONNACK has no assigned ClientID")
+					}
+					assigned = append(assigned, id)
+				}
+			}
+
+			wantConnections := 2
+			if tt.want != packets.Success {
+				wantConnections = 0
+			}
+			if got := mqtt.Connections.Count(); got != wantConnections {
+				t.Errorf("connections = %d, want %d", got, wantConnections)
+			}
+			if len(assigned) == 2 && assigned[0] == assigned[1] {
+				t.Error("clients were assigned the same ClientID")
+			}
+			for _, id := range assigned {
+				if _, ok := mqtt.Connections.Get(id); !ok {
+					t.Errorf("no connection registered as %s", id)
+				}
+			}
+		})
+	}
+}
+
+func TestStalledSubscriberTimesOut(t *testing.T) {
+	mqtt := testBroker()
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	subscriber.WriteTimeout = 20 * time.Millisecond
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: subscriber.Session, Filter: "a"})
+
+	// Nothing reads from the subscriber, the publish mustn't block.
+	errs := make(chan error, 1)
+	go func() { errs <- mqtt.HandlePublish(packets.Publish("a", nil, packets.FixedHeaderFlags{}, 0)) }()
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a stalled subscriber")
+	}
+
+	// The stalled connection is closed.
+	if _, err := subscriberClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() error = %v, want %v", err, io.EOF)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// Returned by HandlePacket once the client has sent DISCONNECT.
+var errClientDisconnected = errors.New("Client disconnected")
+
+// DisconnectError ends a connection, MQTT 5 clients are sent the reason code
+// in a DISCONNECT first.
+type DisconnectError struct {
+	ReasonCode byte
+	Err        error
+}
+
+func (de *DisconnectError) Error() string {
+	return de.Err.Error()
+}
+
+// malformed wraps a packet decoding error.
+func malformed(err error) *DisconnectError {
+	if err == packets.ErrMalformedPacket || err == io.EOF {
+		return &DisconnectError{ReasonCode: packets.MalformedPacket, Err: err}
+	}
+	return &DisconnectError{ReasonCode: packets.ProtocolError, Err: err}
+}
+
+// readReasonCode gives the reason code for a failed read, or false if the
+// connection has already gone and there's no one to tell.
+func readReasonCode(err error) (byte, bool) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return packets.KeepAliveTimeout, true
+	}
+	switch err {
+	case packets.ErrPacketTooLarge:
+		return packets.PacketTooLarge, true
+	case packets.ErrMalformedPacket:
+		return packets.MalformedPacket, true
+	}
+	return 0, false
+}
+
+// Disconnect closes the connection from the server's side. MQTT 5 clients
+// are sent the DISCONNECT first, older clients can only have their connection
+// closed. The rest of the teardown happens in CloseConnection once the
+// connection's reads fail.
+func (c *Connection) Disconnect(dp *packets.DisconnectPacket) error {
+	if c.ProtocolVersion >= packets.MQTT5 {
+		if err := c.WritePacket(dp); err != nil {
+			log.Println(err)
+		}
+	}
+	return c.Close()
+}
+
+// DisconnectClient disconnects a client from the server's side, e.g. for
+// administrative action, returning false if it isn't connected.
+func (mqtt *MQTT) DisconnectClient(clientID string, dp *packets.DisconnectPacket) bool {
+	c, ok := mqtt.Connections.Get(clientID)
+	if !ok {
+		return false
+	}
+	if err := c.Disconnect(dp); err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// HandleDisconnect processes the client's DISCONNECT. The will is discarded
+// unless the client asks for it to be published, and MQTT 5 clients can
+// change their session expiry interval on the way out.
+func (mqtt *MQTT) HandleDisconnect(dp *packets.DisconnectPacket, c *Connection) error {
+	if expiry, ok := dp.Properties.Uint32(packets.SessionExpiryIntervalIdentifier); ok {
+		// A session that was to end with its connection can't be kept now.
+		if c.Session.Expiry() == 0 && expiry != 0 {
+			return &DisconnectError{ReasonCode: packets.ProtocolError, Err: errors.New("Session expiry interval set on DISCONNECT")}
+		}
+		if c.Session.SetExpiry(expiry) && expiry == 0 {
+			// The session now ends with the connection, nothing stored for it may outlive it.
+			if err := mqtt.DeleteStored(c.ClientID); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	if dp.ReasonCode == packets.DisconnectWithWill {
+		return nil
+	}
+	if packets.Failed(dp.ReasonCode) {
+		log.Printf("%s disconnected with %s", c.ClientID, packets.ReasonString(dp.ReasonCode))
+	}
+	// Normal disconnect, the will isn't published.
+	mqtt.DiscardWill(c)
+	return nil
+}
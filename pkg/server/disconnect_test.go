@@ -0,0 +1,151 @@
+package server
+
+import (
+	"io"
+	"testing"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+func TestClientDisconnectReasonCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		disconnect []byte
+		wantWill   bool
+	}{
+		{"normal disconnection", []byte{0xE0, 0}, false},
+		{"disconnect with will", []byte{0xE0, 1, packets.DisconnectWithWill}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			subscriber, subscriberClient := pipeConnection("subscriber")
+			mqtt.Subscriptions.Subscribe(&Subscription{Session: subscriber.Session, Filter: "presence/+"})
+
+			device, deviceClient := pipeConnection("device")
+			device.ProtocolVersion = packets.MQTT5
+			device.Will = &models.Will{ClientID: "device", Topic: "presence/d", Payload: []byte("0")}
+
+			done := make(chan struct{})
+			go func() {
+				mqtt.HandleConnection(device)
+				close(done)
+			}()
+			deviceClient.Write(tt.disconnect)
+
+			if tt.wantWill {
+				expectBytes(t, subscriberClient, []byte{0x30, 13, 0, 10, 'p', 'r', 'e', 's', 'e', 'n', 'c', 'e', '/', 'd', '0'})
+			}
+			<-done
+			if device.Will != nil {
+				t.Error("will kept after the connection closed")
+			}
+		})
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		// Sent by the client, nil for an administrative disconnect.
+		send []byte
+		want []byte
+	}{
+		{
+			name:    "administrative action with reason string",
+			version: packets.MQTT5,
+			want:    []byte{0xE0, 16, packets.AdministrativeAction, 14, 0x1F, 0, 11, 'm', 'a', 'i', 'n', 't', 'e', 'n', 'a', 'n', 'c', 'e'},
+		},
+		{
+			name:    "reserved packet type",
+			version: packets.MQTT5,
+			send:    []byte{0x00, 0},
+			want:    []byte{0xE0, 1, packets.MalformedPacket},
+		},
+		{
+			name:    "truncated PUBLISH",
+			version: packets.MQTT5,
+			send:    []byte{0x30, 1, 0},
+			want:    []byte{0xE0, 1, packets.MalformedPacket},
+		},
+		{
+			name:    "truncated SUBSCRIBE",
+			version: packets.MQTT5,
+			send:    []byte{0x82, 4, 0, 1, 0, 0},
+			want:    []byte{0xE0, 1, packets.MalformedPacket},
+		},
+		{
+			name:    "second CONNECT",
+			version: packets.MQTT5,
+			send:    []byte{0x10, 0},
+			want:    []byte{0xE0, 1, packets.ProtocolError},
+		},
+		{
+			name:    "MQTT 3.1.1 client is only closed",
+			version: packets.MQTT311,
+			send:    []byte{0x00, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			c, client := pipeConnection("device")
+			c.ProtocolVersion = tt.version
+			mqtt.Connections.Register(c)
+
+			done := make(chan struct{})
+			go func() {
+				mqtt.HandleConnection(c)
+				close(done)
+			}()
+			if tt.send != nil {
+				go client.Write(tt.send)
+			} else {
+				go mqtt.DisconnectClient("device", packets.DisconnectWithReason(packets.AdministrativeAction, "maintenance"))
+			}
+
+			expectBytes(t, client, tt.want)
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("connection still open, read error = %v", err)
+			}
+			<-done
+			if _, ok := mqtt.Connections.Get("device"); ok {
+				t.Error("connection still registered after disconnect")
+			}
+		})
+	}
+}
+
+func TestDisconnectEndsSession(t *testing.T) {
+	mqtt := testBroker()
+	cp := &packets.ConnectPacket{ClientID: "device", ProtocolVersion: packets.MQTT5, SessionExpiryInterval: 60}
+	session, _ := mqtt.ResumeSession(cp)
+	c, client := pipeConnection("device")
+	c.ProtocolVersion = packets.MQTT5
+	c.Session = session
+	session.Attach(c)
+	mqtt.Connections.Register(c)
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: session, Filter: "commands/device", QoS: 1})
+	mqtt.SubscriptionService.Create(&models.Subscription{ClientID: "device", Filter: "commands/device", QoS: 1})
+
+	done := make(chan struct{})
+	go func() {
+		mqtt.HandleConnection(c)
+		close(done)
+	}()
+	// Session expiry interval of zero, the session ends with the connection.
+	client.Write([]byte{0xE0, 7, packets.Success, 5, packets.SessionExpiryIntervalIdentifier, 0, 0, 0, 0})
+	<-done
+
+	if _, ok := mqtt.Sessions.Get("device"); ok {
+		t.Error("session kept after disconnecting with a zero expiry interval")
+	}
+	if got := mqtt.Subscriptions.Count(); got != 0 {
+		t.Errorf("subscriptions = %d, want 0", got)
+	}
+	if stored, _ := mqtt.SubscriptionService.All(); len(stored) != 0 {
+		t.Errorf("stored subscriptions = %d, want 0", len(stored))
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+const (
+	// Session expiry interval given to MQTT 3.1.1 and 3.1 clients that don't ask for a clean session.
+	DefaultSessionExpiryInterval = 24 * 60 * 60
+	// Sessions with this expiry interval are kept until the client asks for a clean start.
+	SessionNeverExpires = 0xFFFFFFFF
+	// How often expired sessions are looked for.
+	DefaultReapInterval = time.Minute
+)
+
+// SessionExpiry returns the number of seconds a client's session is kept
+// after it disconnects. MQTT 5 clients ask for an interval in CONNECT,
+// earlier clients either get a clean session or the broker's default.
+func (mqtt *MQTT) SessionExpiry(cp *packets.ConnectPacket) uint32 {
+	if cp.ProtocolVersion >= packets.MQTT5 {
+		return cp.SessionExpiryInterval
+	}
+	if cp.CleanStartFlag {
+		return 0
+	}
+	return mqtt.SessionExpiryInterval
+}
+
+// DetachSession updates a session whose client has disconnected. Sessions
+// without an expiry interval end immediately, others are given an expiry
+// time for the reaper.
+func (mqtt *MQTT) DetachSession(s *Session) error {
+	if !s.Persistent() {
+		if err := mqtt.EndSession(s); err != nil {
+			return err
+		}
+		return mqtt.SessionService.Delete(s.ClientID)
+	}
+
+	var expiresAt *time.Time
+	if expiry := s.Expiry(); expiry != SessionNeverExpires {
+		t := time.Now().Add(time.Duration(expiry) * time.Second)
+		expiresAt = &t
+	}
+	return mqtt.SessionService.Expire(s.ClientID, expiresAt)
+}
+
+// ReapSessions removes every session that had expired by now, along with
+// its subscriptions and queued messages.
+func (mqtt *MQTT) ReapSessions(now time.Time) error {
+	expired, err := mqtt.SessionService.Expired(now)
+	if err != nil {
+		return err
+	}
+
+	for _, expiredSession := range expired {
+		clientID := expiredSession.ClientID
+		if s, ok := mqtt.Sessions.Get(clientID); ok {
+			// The client reconnected since the session was last updated.
+			if s.Connection() != nil {
+				continue
+			}
+			if err := mqtt.EndSession(s); err != nil {
+				return err
+			}
+		}
+		if err := mqtt.SubscriptionService.DeleteByClientID(clientID); err != nil {
+			return err
+		}
+		if err := mqtt.MessageService.DeleteByClientID(clientID); err != nil {
+			return err
+		}
+		if err := mqtt.SessionService.Delete(clientID); err != nil {
+			return err
+		}
+		log.Printf("Session for %s expired", clientID)
+	}
+	return nil
+}
+
+// ReapExpiredSessions runs ReapSessions every interval until done is closed.
+func (mqtt *MQTT) ReapExpiredSessions(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := mqtt.ReapSessions(now); err != nil {
+				log.Println(err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
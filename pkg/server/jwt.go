@@ -0,0 +1,433 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// Signing algorithms JWT keys can verify.
+const (
+	HS256 = "HS256" //HMAC using SHA-256
+	RS256 = "RS256" //RSASSA-PKCS1-v1_5 using SHA-256
+	ES256 = "ES256" //ECDSA using P-256 and SHA-256
+)
+
+var (
+	ErrJWTMalformed = errors.New("Malformed JWT")
+	ErrJWTSignature = errors.New("JWT signature invalid")
+	ErrJWTExpired   = errors.New("JWT expired")
+	ErrJWTNotBefore = errors.New("JWT not valid yet")
+	ErrJWTAudience  = errors.New("JWT audience not accepted")
+	ErrJWTClientID  = errors.New("JWT issued for another ClientID")
+	ErrJWTKey       = errors.New("Key can't be used for the algorithm")
+)
+
+// JWTKey verifies tokens signed with one algorithm.
+type JWTKey struct {
+	// Key ID tokens name in their kid header, empty verifies any token.
+	ID        string
+	Algorithm string
+	// The []byte secret for HS256, *rsa.PublicKey for RS256 or *ecdsa.PublicKey for ES256.
+	Key interface{}
+}
+
+// JWT authenticates clients sending a JSON Web Token as their CONNECT
+// password. Tokens must be signed by one of the keys and not have expired,
+// clients are disconnected once their token does. Clients without a
+// password, or whose password isn't a JWT, are left to the next
+// authenticator.
+type JWT struct {
+	Keys []JWTKey
+	// Audience tokens must be issued for, empty accepts any.
+	Audience string
+	// Claim holding the username, sub if empty.
+	UsernameClaim string
+	// Claim the client's ClientID must equal, empty doesn't check it.
+	ClientIDClaim string
+	// Claim holding the client's rules as {"publish": [...], "subscribe": [...]}
+	// topic filter lists. Empty gives clients no rules of their own, tokens
+	// without the claim get an empty ACL.
+	ACLClaim string
+	// Clock skew allowed when checking exp and nbf.
+	Leeway time.Duration
+}
+
+func (j *JWT) Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error) {
+	if !cp.PasswordFlag {
+		return nil, ErrNoDecision
+	}
+	header, claims, err := parseJWT(string(cp.Password))
+	if err != nil {
+		return nil, ErrNoDecision
+	}
+
+	identity, err := j.verify(string(cp.Password), header, claims, cp.ClientID)
+	switch err {
+	case nil:
+		return identity, nil
+	case ErrJWTAudience, ErrJWTClientID:
+		log.Printf("%s: %v", cp.ClientID, err)
+		return nil, ErrNotAuthorised
+	}
+	log.Printf("%s: %v", cp.ClientID, err)
+	return nil, ErrBadCredentials
+}
+
+// jwtHeader is the part of a JOSE header needed to pick a key.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// parseJWT decodes a token's header and claims without verifying them.
+func parseJWT(token string) (*jwtHeader, map[string]json.RawMessage, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, ErrJWTMalformed
+	}
+	header := &jwtHeader{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, nil, err
+	}
+	claims := map[string]json.RawMessage{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, nil, err
+	}
+	return header, claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrJWTMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrJWTMalformed
+	}
+	return nil
+}
+
+// verify checks the token's signature and claims, returning who it identifies.
+func (j *JWT) verify(token string, header *jwtHeader, claims map[string]json.RawMessage, clientID string) (*Identity, error) {
+	i := strings.LastIndex(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	if !j.verifySignature(header, []byte(token[:i]), signature) {
+		return nil, ErrJWTSignature
+	}
+
+	now := time.Now()
+	identity := &Identity{}
+	if exp, ok, err := timeClaim(claims, "exp"); err != nil {
+		return nil, err
+	} else if ok {
+		identity.Expires = exp.Add(j.Leeway)
+		if !now.Before(identity.Expires) {
+			return nil, ErrJWTExpired
+		}
+	}
+	if nbf, ok, err := timeClaim(claims, "nbf"); err != nil {
+		return nil, err
+	} else if ok && now.Add(j.Leeway).Before(nbf) {
+		return nil, ErrJWTNotBefore
+	}
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return nil, ErrJWTAudience
+	}
+
+	if j.ClientIDClaim != "" {
+		if id, _ := stringClaim(claims, j.ClientIDClaim); id == "" || id != clientID {
+			return nil, ErrJWTClientID
+		}
+	}
+	usernameClaim := j.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	identity.Username, _ = stringClaim(claims, usernameClaim)
+
+	if j.ACLClaim != "" {
+		identity.ACL, err = aclClaim(claims[j.ACLClaim])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return identity, nil
+}
+
+// verifySignature reports whether any key for the token's algorithm signed it.
+func (j *JWT) verifySignature(header *jwtHeader, signed, signature []byte) bool {
+	for _, key := range j.Keys {
+		if key.Algorithm != header.Algorithm || key.ID != "" && header.KeyID != "" && key.ID != header.KeyID {
+			continue
+		}
+		if key.verify(signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k JWTKey) verify(signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch key := k.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return k.Algorithm == HS256 && hmac.Equal(signature, mac.Sum(nil))
+	case *rsa.PublicKey:
+		return k.Algorithm == RS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// ES256 signatures are the 32 byte r and s values concatenated.
+		if k.Algorithm != ES256 || key.Curve != elliptic.P256() || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	return false
+}
+
+// stringClaim returns a claim that's a string, or false if it's missing or isn't one.
+func stringClaim(claims map[string]json.RawMessage, name string) (string, bool) {
+	var s string
+	if raw, ok := claims[name]; !ok || json.Unmarshal(raw, &s) != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// timeClaim returns a NumericDate claim, or false if the token doesn't have it.
+func timeClaim(claims map[string]json.RawMessage, name string) (time.Time, bool, error) {
+	raw, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err != nil {
+		return time.Time{}, false, ErrJWTMalformed
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+}
+
+// hasAudience reports whether an aud claim, a string or list of strings, includes audience.
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) != nil {
+		return false
+	}
+	for _, aud := range many {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// aclClaim converts a token's topic filter lists into rules, subscribing
+// includes reading retained messages.
+func aclClaim(raw json.RawMessage) (ACL, error) {
+	acl := ACL{}
+	if raw == nil {
+		return acl, nil
+	}
+	var lists struct {
+		Publish   []string `json:"publish"`
+		Subscribe []string `json:"subscribe"`
+	}
+	if err := json.Unmarshal(raw, &lists); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	for _, topic := range lists.Publish {
+		acl = append(acl, ACLRule{Topic: topic, Actions: PublishAction})
+	}
+	for _, topic := range lists.Subscribe {
+		acl = append(acl, ACLRule{Topic: topic, Actions: SubscribeAction | RetainedReadAction})
+	}
+	return acl, nil
+}
+
+// LoadJWTKey reads a key for algorithm from a file, which holds the secret
+// itself for HS256, or a PEM public key or certificate otherwise.
+func LoadJWTKey(path, algorithm string) (JWTKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return JWTKey{}, err
+	}
+	key := JWTKey{Algorithm: algorithm}
+	switch algorithm {
+	case HS256:
+		key.Key = bytes.TrimSpace(b)
+	case RS256, ES256:
+		key.Key, err = parsePublicKey(b)
+	default:
+		err = fmt.Errorf("Unsupported JWT algorithm %s", algorithm)
+	}
+	if err == nil {
+		err = key.check()
+	}
+	if err != nil {
+		return JWTKey{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+func parsePublicKey(b []byte) (interface{}, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("No PEM block found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("Unsupported PEM block %s", block.Type)
+}
+
+// check reports whether the key suits its algorithm.
+func (k JWTKey) check() error {
+	switch key := k.Key.(type) {
+	case []byte:
+		if k.Algorithm == HS256 && len(key) > 0 {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if k.Algorithm == RS256 {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if k.Algorithm == ES256 && key.Curve == elliptic.P256() {
+			return nil
+		}
+	}
+	return ErrJWTKey
+}
+
+// jwk is a JSON Web Key, only the members needed for the supported algorithms are read.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	K         string `json:"k"`
+}
+
+// LoadJWKS reads the keys of a JSON Web Key Set file.
+func LoadJWKS(path string) ([]JWTKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseJWKS(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return keys, nil
+}
+
+// ParseJWKS decodes a JSON Web Key Set. Keys for other uses or
+// unsupported algorithms are skipped.
+func ParseJWKS(b []byte) ([]JWTKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []JWTKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err == ErrJWTKey {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Key %q: %v", k.KeyID, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// key decodes the JWK, returning ErrJWTKey if it isn't for a supported algorithm.
+func (k jwk) key() (JWTKey, error) {
+	key := JWTKey{ID: k.KeyID, Algorithm: k.Algorithm}
+	var err error
+	switch {
+	case k.KeyType == "oct" && (k.Algorithm == "" || k.Algorithm == HS256):
+		key.Algorithm = HS256
+		key.Key, err = base64.RawURLEncoding.DecodeString(k.K)
+	case k.KeyType == "RSA" && (k.Algorithm == "" || k.Algorithm == RS256):
+		key.Algorithm = RS256
+		var n, e []byte
+		if n, err = base64.RawURLEncoding.DecodeString(k.N); err == nil {
+			e, err = base64.RawURLEncoding.DecodeString(k.E)
+		}
+		if err == nil && len(e) > 4 {
+			err = errors.New("RSA exponent too large")
+		}
+		if err == nil {
+			key.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		}
+	case k.KeyType == "EC" && k.Curve == "P-256" && (k.Algorithm == "" || k.Algorithm == ES256):
+		key.Algorithm = ES256
+		var x, y []byte
+		if x, err = base64.RawURLEncoding.DecodeString(k.X); err == nil {
+			y, err = base64.RawURLEncoding.DecodeString(k.Y)
+		}
+		if err == nil {
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				err = errors.New("Point is not on the curve")
+			}
+			key.Key = pub
+		}
+	default:
+		return JWTKey{}, ErrJWTKey
+	}
+	if err != nil {
+		return JWTKey{}, err
+	}
+	return key, key.check()
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+var (
+	jwtSecret   = []byte("secret")
+	rsaKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	ecdsaKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// signJWT builds a token with the given header and claims, signed with the test key for alg.
+func signJWT(t *testing.T, header, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch header["alg"] {
+	case HS256:
+		mac := hmac.New(sha256.New, jwtSecret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case RS256:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, ecdsaKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// r and s are padded to 32 bytes each.
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testJWT() *JWT {
+	return &JWT{
+		Keys: []JWTKey{
+			{Algorithm: HS256, Key: jwtSecret},
+			{ID: "rsa", Algorithm: RS256, Key: &rsaKey.PublicKey},
+			{ID: "ec", Algorithm: ES256, Key: &ecdsaKey.PublicKey},
+		},
+		Audience:      "broker",
+		ClientIDClaim: "client_id",
+		ACLClaim:      "mqtt",
+	}
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	now := time.Now().Unix()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":       "app",
+			"aud":       []string{"api", "broker"},
+			"exp":       now + 60,
+			"nbf":       now - 60,
+			"client_id": "device",
+			"mqtt":      map[string][]string{"publish": {"devices/device/#"}, "subscribe": {"commands/device"}},
+		}
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := valid()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	// The claims of one token with the signature of another.
+	admin := signJWT(t, map[string]interface{}{"alg": HS256}, with("sub", "admin"))
+	app := signJWT(t, map[string]interface{}{"alg": HS256}, valid())
+	tampered := admin[:strings.LastIndex(admin, ".")] + app[strings.LastIndex(app, "."):]
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  error
+	}{
+		{"HS256", signJWT(t, map[string]interface{}{"alg": HS256}, valid()), nil},
+		{"RS256", signJWT(t, map[string]interface{}{"alg": RS256, "kid": "rsa"}, valid()), nil},
+		{"ES256", signJWT(t, map[string]interface{}{"alg": ES256, "kid": "ec"}, valid()), nil},
+		{"audience string", signJWT(t, map[string]interface{}{"alg": HS256}, with("aud", "broker")), nil},
+		{"not a JWT", "secret", ErrNoDecision},
+		{"unknown key ID", signJWT(t, map[string]interface{}{"alg": RS256, "kid": "other"}, valid()), ErrBadCredentials},
+		{"algorithm none", signJWT(t, map[string]interface{}{"alg": "none"}, valid()), ErrBadCredentials},
+		{"tampered claims", tampered, ErrBadCredentials},
+		{"expired", signJWT(t, map[string]interface{}{"alg": HS256}, with("exp", now-1)), ErrBadCredentials},
+		{"not valid yet", signJWT(t, map[string]interface{}{"alg": HS256}, with("nbf", now+60)), ErrBadCredentials},
+		{"wrong audience", signJWT(t, map[string]interface{}{"alg": HS256}, with("aud", "api")), ErrNotAuthorised},
+		{"missing audience", signJWT(t, map[string]interface{}{"alg": HS256}, with("aud", nil)), ErrNotAuthorised},
+		{"other ClientID", signJWT(t, map[string]interface{}{"alg": HS256}, with("client_id", "other")), ErrNotAuthorised},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp := &packets.ConnectPacket{ClientID: "device", PasswordFlag: true, Password: []byte(tt.password)}
+			identity, err := testJWT().Authenticate(cp, &ConnectInfo{})
+			if err != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if identity.Username != "app" {
+				t.Errorf("Username = %q, want app", identity.Username)
+			}
+			if !identity.Expires.Equal(time.Unix(now+60, 0)) {
+				t.Errorf("Expires = %v, want %v", identity.Expires, time.Unix(now+60, 0))
+			}
+			c := &Connection{ClientID: "device", Username: identity.Username}
+			if identity.ACL.Authorize(c, PublishAction, "devices/device/temperature") != nil {
+				t.Error("publishing to the token's topics was not allowed")
+			}
+			if identity.ACL.Authorize(c, RetainedReadAction, "commands/device") != nil {
+				t.Error("reading retained messages from subscribed topics was not allowed")
+			}
+			if identity.ACL.Authorize(c, SubscribeAction, "devices/device/temperature") != ErrNoDecision {
+				t.Error("subscribing to publish topics was allowed")
+			}
+		})
+	}
+}
+
+func TestLoadJWTKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKIXPublicKey(&ecdsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	secretPath := write("secret", append(jwtSecret, '\n'))
+	ecPath := write("ec.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	rsaPath := write("rsa.pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)}))
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecdsaKey.X.Bytes()), "y": b64(ecdsaKey.Y.Bytes())},
+		{"kty": "oct", "kid": "hmac", "alg": HS256, "k": b64(jwtSecret)},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "OKP", "kid": "ed25519", "crv": "Ed25519", "x": "AA"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksPath := write("jwks.json", jwks)
+
+	var keys []JWTKey
+	for _, file := range []struct{ path, algorithm string }{{secretPath, HS256}, {ecPath, ES256}, {rsaPath, RS256}} {
+		key, err := LoadJWTKey(file.path, file.algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if _, err := LoadJWTKey(ecPath, RS256); err == nil {
+		t.Error("EC key loaded for RS256")
+	}
+	set, err := LoadJWKS(jwksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 3 {
+		t.Fatalf("loaded %d keys from the JWKS, want 3", len(set))
+	}
+
+	claims := map[string]interface{}{"sub": "app"}
+	for _, keys := range [][]JWTKey{keys, set} {
+		j := &JWT{Keys: keys}
+		for _, header := range []map[string]interface{}{{"alg": HS256}, {"alg": RS256, "kid": "rsa"}, {"alg": ES256, "kid": "ec"}} {
+			cp := &packets.ConnectPacket{ClientID: "device", PasswordFlag: true, Password: []byte(signJWT(t, header, claims))}
+			if _, err := j.Authenticate(cp, &ConnectInfo{}); err != nil {
+				t.Errorf("%s token not verified: %v", header["alg"], err)
+			}
+		}
+	}
+}
+
+func TestJWTExpiryDisconnects(t *testing.T) {
+	mqtt := testBroker()
+	mqtt.Authenticator = &JWT{Keys: []JWTKey{{Algorithm: HS256, Key: jwtSecret}}}
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// Expiring on the next whole second, up to a second away.
+	expires := time.Now().Truncate(time.Second).Add(time.Second)
+	token := signJWT(t, map[string]interface{}{"alg": HS256}, map[string]interface{}{"sub": "app", "exp": expires.Unix()})
+	cp := &packets.ConnectPacket{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: packets.MQTT5,
+		CleanStartFlag:  true,
+		ClientID:        "device",
+		PasswordFlag:    true,
+		Password:        []byte(token),
+	}
+	b, err := cp.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write(b)
+	go mqtt.HandleNewConn(server)
+
+	ca, err := packets.NewConnackPacket(readFrame(t, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.ReturnCode != packets.Success {
+		t.Fatalf("CONNACK reason code = %#x, want success", ca.ReturnCode)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.NewMQTTPacket(readFrame(t, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Before(expires) {
+		t.Error("disconnected before the token expired")
+	}
+	p.Version = packets.MQTT5
+	dp, err := packets.NewDisconnectPacket(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dp.ReasonCode != packets.NotAuthorized {
+		t.Errorf("DISCONNECT reason code = %#x, want not authorized", dp.ReasonCode)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// How long a new connection has to send CONNECT.
+const DefaultConnectTimeout = 10 * time.Second
+
+// How long a write to a client can take before its connection is closed.
+const DefaultWriteTimeout = 10 * time.Second
+
+// Largest packet accepted from a client by default, in bytes.
+const DefaultMaxPacketSize = 1 << 20
+
+// KeepAlive returns the keep alive the connection will run with, the
+// server's keep alive replaces an MQTT 5 client's when one is configured.
+// Older clients can't be told about it in the CONNACK, so keep their own.
+func (mqtt *MQTT) KeepAlive(cp *packets.ConnectPacket) uint16 {
+	if mqtt.ServerKeepAlive > 0 && cp.ProtocolVersion >= packets.MQTT5 {
+		return mqtt.ServerKeepAlive
+	}
+	return cp.KeepAlive
+}
+
+// ExtendDeadline gives the client one and a half keep alive periods to send
+// its next packet, after which reads fail and the connection is closed.
+func (c *Connection) ExtendDeadline() error {
+	if c.KeepAlive == 0 {
+		return c.Conn.SetReadDeadline(time.Time{})
+	}
+	timeout := time.Duration(c.KeepAlive) * 1500 * time.Millisecond
+	return c.Conn.SetReadDeadline(time.Now().Add(timeout))
+}
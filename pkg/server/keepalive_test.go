@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+func TestKeepAliveOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		server  uint16
+		client  uint16
+		want    uint16
+	}{
+		{"client keep alive", packets.MQTT5, 0, 60, 60},
+		{"server override", packets.MQTT5, 30, 60, 30},
+		{"server override disabled client", packets.MQTT5, 30, 0, 30},
+		{"disabled", packets.MQTT5, 0, 0, 0},
+		{"MQTT 3.1.1 client keeps its own", packets.MQTT311, 30, 60, 60},
+		{"MQTT 3.1 client keeps its own", packets.MQTT31, 30, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := &MQTT{ServerKeepAlive: tt.server}
+			if got := mqtt.KeepAlive(&packets.ConnectPacket{ProtocolVersion: tt.version, KeepAlive: tt.client}); got != tt.want {
+				t.Errorf("KeepAlive() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepAliveExpiryPublishesWill(t *testing.T) {
+	mqtt := testBroker()
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: subscriber.Session, Filter: "presence/+"})
+
+	device, _ := pipeConnection("device")
+	device.KeepAlive = 1
+	device.Will = &models.Will{ClientID: "device", Topic: "presence/device", Payload: []byte("0")}
+	mqtt.Connections.Register(device)
+
+	// The device never sends anything, after one and a half keep alives it's dropped.
+	started := time.Now()
+	go mqtt.HandleConnection(device)
+	expectBytes(t, subscriberClient, []byte{0x30, 18, 0, 15, 'p', 'r', 'e', 's', 'e', 'n', 'c', 'e', '/', 'd', 'e', 'v', 'i', 'c', 'e', '0'})
+	if elapsed := time.Since(started); elapsed < 1500*time.Millisecond {
+		t.Errorf("connection closed after %v, before the keep alive expired", elapsed)
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// How often Watch checks files for changes by default.
+const DefaultWatchInterval = 5 * time.Second
+
+// PasswordFile authenticates clients against a mosquitto password file of
+// "username:hash" lines. Clients without a username or with one not in the
+// file are left to the next authenticator.
+type PasswordFile struct {
+	watchedFile
+
+	mu     sync.RWMutex
+	hashes map[string]string
+}
+
+// LoadPasswordFile reads a mosquitto password file.
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	pf := &PasswordFile{watchedFile: watchedFile{Path: path}}
+	if err := pf.Reload(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// Reload rereads the file, keeping the current passwords if it can't be parsed.
+func (pf *PasswordFile) Reload() error {
+	f, err := pf.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes, err := parsePasswordFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", pf.Path, err)
+	}
+	pf.mu.Lock()
+	pf.hashes = hashes
+	pf.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the file whenever it changes until done is closed.
+func (pf *PasswordFile) Watch(interval time.Duration, done <-chan struct{}) {
+	pf.watch(interval, done, pf.Reload)
+}
+
+func (pf *PasswordFile) Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error) {
+	if !cp.UsernameFlag {
+		return nil, ErrNoDecision
+	}
+	pf.mu.RLock()
+	hash, ok := pf.hashes[cp.Username]
+	pf.mu.RUnlock()
+	if !ok {
+		return nil, ErrNoDecision
+	}
+
+	match, err := models.CheckPassword(hash, string(cp.Password))
+	if err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, ErrBadCredentials
+	}
+	return &Identity{Username: cp.Username}, nil
+}
+
+func (pf *PasswordFile) Identify(username string, info *ConnectInfo) (*Identity, error) {
+	pf.mu.RLock()
+	_, ok := pf.hashes[username]
+	pf.mu.RUnlock()
+	if !ok {
+		return nil, ErrNoDecision
+	}
+	return &Identity{Username: username}, nil
+}
+
+// ParsePasswordFile reads a mosquitto password file as an Authenticator.
+func ParsePasswordFile(r io.Reader) (*PasswordFile, error) {
+	hashes, err := parsePasswordFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordFile{hashes: hashes}, nil
+}
+
+// parsePasswordFile reads the hashes of a password file by username.
+func parsePasswordFile(r io.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			return nil, fmt.Errorf("Line %d is not username:hash", n)
+		}
+		hashes[line[:i]] = line[i+1:]
+	}
+	return hashes, scanner.Err()
+}
+
+// ACLFile authorizes clients with a mosquitto acl_file. Topic rules before
+// the first user line apply to anonymous clients, the rest to the user
+// above them, and pattern rules to every client. As in mosquitto, a
+// matching deny rule wins over any rule allowing the topic.
+type ACLFile struct {
+	watchedFile
+
+	mu    sync.RWMutex
+	rules *aclFileRules
+}
+
+// aclFileRules is a parsed acl_file.
+type aclFileRules struct {
+	anonymous ACL
+	users     map[string]ACL
+	patterns  ACL
+}
+
+// LoadACLFile reads a mosquitto acl_file.
+func LoadACLFile(path string) (*ACLFile, error) {
+	af := &ACLFile{watchedFile: watchedFile{Path: path}}
+	if err := af.Reload(); err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+// Reload rereads the file, keeping the current rules if it can't be parsed.
+func (af *ACLFile) Reload() error {
+	f, err := af.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules, err := parseACLFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", af.Path, err)
+	}
+	af.mu.Lock()
+	af.rules = rules
+	af.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the file whenever it changes until done is closed.
+func (af *ACLFile) Watch(interval time.Duration, done <-chan struct{}) {
+	af.watch(interval, done, af.Reload)
+}
+
+func (af *ACLFile) Authorize(c *Connection, action Action, topic string) error {
+	af.mu.RLock()
+	rules := af.rules
+	af.mu.RUnlock()
+
+	own := rules.anonymous
+	if c.Username != "" {
+		own = rules.users[c.Username]
+	}
+	// Deny rules are checked first, whichever section they're in.
+	for _, deny := range []bool{true, false} {
+		for _, acl := range []ACL{own, rules.patterns} {
+			if err := filterRules(acl, deny).Authorize(c, action, topic); err != ErrNoDecision {
+				return err
+			}
+		}
+	}
+	return ErrNoDecision
+}
+
+func filterRules(acl ACL, deny bool) ACL {
+	var filtered ACL
+	for _, rule := range acl {
+		if rule.Deny == deny {
+			filtered = append(filtered, rule)
+		}
+	}
+	return filtered
+}
+
+// Actions granted by each acl_file access type, read covers subscribing
+// and receiving retained messages.
+var aclFileAccess = map[string]Action{
+	"read":      SubscribeAction | RetainedReadAction,
+	"write":     PublishAction,
+	"readwrite": PublishAction | SubscribeAction | RetainedReadAction,
+	"deny":      PublishAction | SubscribeAction | RetainedReadAction,
+}
+
+// ParseACLFile reads a mosquitto acl_file as an Authorizer.
+func ParseACLFile(r io.Reader) (*ACLFile, error) {
+	rules, err := parseACLFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return &ACLFile{rules: rules}, nil
+}
+
+func parseACLFile(r io.Reader) (*aclFileRules, error) {
+	rules := &aclFileRules{users: make(map[string]ACL)}
+	username := ""
+	inUser := false
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Line %d has no value", n)
+		}
+		directive, value := fields[0], strings.TrimSpace(fields[1])
+
+		if directive == "user" {
+			username, inUser = value, true
+			if _, ok := rules.users[username]; !ok {
+				rules.users[username] = ACL{}
+			}
+			continue
+		}
+		if directive != "topic" && directive != "pattern" {
+			return nil, fmt.Errorf("Line %d has unknown directive %s", n, directive)
+		}
+
+		// Access is optional and defaults to readwrite.
+		access := "readwrite"
+		if fields := strings.SplitN(value, " ", 2); len(fields) == 2 {
+			if _, ok := aclFileAccess[fields[0]]; ok {
+				access, value = fields[0], strings.TrimSpace(fields[1])
+			}
+		}
+		rule := ACLRule{Topic: value, Actions: aclFileAccess[access], Deny: access == "deny"}
+
+		switch {
+		case directive == "pattern":
+			rules.patterns = append(rules.patterns, rule)
+		case inUser:
+			rules.users[username] = append(rules.users[username], rule)
+		default:
+			rules.anonymous = append(rules.anonymous, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// watchedFile remembers which version of a file was last read, so changes
+// can be picked up.
+type watchedFile struct {
+	Path string
+
+	readMu sync.Mutex
+	read   os.FileInfo
+}
+
+// open opens the file, remembering the version being read.
+func (wf *watchedFile) open() (*os.File, error) {
+	f, err := os.Open(wf.Path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	wf.readMu.Lock()
+	wf.read = info
+	wf.readMu.Unlock()
+	return f, nil
+}
+
+// changed reports whether the file's modification time or size differs
+// from the version last read.
+func (wf *watchedFile) changed() (bool, error) {
+	info, err := os.Stat(wf.Path)
+	if err != nil {
+		return false, err
+	}
+	wf.readMu.Lock()
+	defer wf.readMu.Unlock()
+	return wf.read == nil || !info.ModTime().Equal(wf.read.ModTime()) || info.Size() != wf.read.Size(), nil
+}
+
+// watch calls reload whenever the file changes, checking every interval
+// until done is closed. A file that fails to load isn't retried until it
+// changes again.
+func (wf *watchedFile) watch(interval time.Duration, done <-chan struct{}, reload func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			changed, err := wf.changed()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if err := reload(); err != nil {
+				log.Println(err)
+				continue
+			}
+			log.Printf("Reloaded %s", wf.Path)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// "password" hashed by mosquitto_passwd.
+const mosquittoHash = "$7$101$MDEyMzQ1Njc4OWFi$uAhjSMFrFKPND0iWyTXsxET36hDBAvu7LqiX1au82iDOT9W7IG9XGjasDAepCB3nZMPp79k+PyCilDXRAZuIVA=="
+
+func credentials(username, password string) *packets.ConnectPacket {
+	return &packets.ConnectPacket{
+		ClientID:     "device",
+		UsernameFlag: username != "",
+		Username:     username,
+		PasswordFlag: password != "",
+		Password:     []byte(password),
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	pf, err := ParsePasswordFile(strings.NewReader("# migrated from mosquitto\n\nsensor:" + mosquittoHash + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{"right password", "sensor", "password", nil},
+		{"wrong password", "sensor", "guess", ErrBadCredentials},
+		{"unknown user", "other", "password", ErrNoDecision},
+		{"anonymous", "", "", ErrNoDecision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := pf.Authenticate(credentials(tt.username, tt.password), &ConnectInfo{}); err != tt.wantErr {
+				t.Errorf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := ParsePasswordFile(strings.NewReader("sensor\n")); err == nil {
+		t.Error("line without a hash was accepted")
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	af, err := ParseACLFile(strings.NewReader(`
+# Anonymous clients can only read public topics.
+topic read public/#
+
+user alice
+topic tenants/alice/#
+topic deny tenants/alice/billing
+topic write audit
+
+user bob
+topic read tenants/bob/#
+
+pattern write devices/%c/status
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		username string
+		action   Action
+		topic    string
+		want     error
+	}{
+		{"anonymous reads public", "", SubscribeAction, "public/news", nil},
+		{"anonymous can't write public", "", PublishAction, "public/news", ErrNoDecision},
+		{"user doesn't get anonymous rules", "bob", SubscribeAction, "public/news", ErrNoDecision},
+		{"readwrite by default", "alice", PublishAction, "tenants/alice/status", nil},
+		{"deny wins over an earlier allow", "alice", PublishAction, "tenants/alice/billing", ErrNotAuthorised},
+		{"deny overlaps a wide subscription", "alice", SubscribeAction, "tenants/alice/#", ErrNotAuthorised},
+		{"write only", "alice", SubscribeAction, "audit", ErrNoDecision},
+		{"read includes retained", "bob", RetainedReadAction, "tenants/bob/config", nil},
+		{"read only", "bob", PublishAction, "tenants/bob/config", ErrNoDecision},
+		{"pattern with client ID", "bob", PublishAction, "devices/device/status", nil},
+		{"pattern for another client", "bob", PublishAction, "devices/other/status", ErrNoDecision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Connection{ClientID: "device", Username: tt.username}
+			if err := af.Authorize(c, tt.action, tt.topic); err != tt.want {
+				t.Errorf("Authorize() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseACLFile(strings.NewReader("topics read #\n")); err == nil {
+		t.Error("unknown directive was accepted")
+	}
+}
+
+// replaceFile swaps in new contents in one step, so a watcher never reads a
+// half written file.
+func replaceFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path+".new", []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordFileWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(path, []byte("sensor:"+mosquittoHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go pf.Watch(10*time.Millisecond, done)
+
+	replaceFile(t, path, "sensor:"+mosquittoHash+"\ngateway:"+mosquittoHash+"\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := pf.Authenticate(credentials("gateway", "password"), &ConnectInfo{}); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("password file was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A broken file leaves the loaded passwords in place.
+	replaceFile(t, path, "not a password file\n")
+	time.Sleep(50 * time.Millisecond)
+	if _, err := pf.Authenticate(credentials("sensor", "password"), &ConnectInfo{}); err != nil {
+		t.Errorf("Authenticate() after a bad reload error = %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"log"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// ResumeSession returns the session for a connecting client and whether it
+// existed before. A clean start discards any existing session and everything
+// stored for it.
+func (mqtt *MQTT) ResumeSession(cp *packets.ConnectPacket) (*Session, bool) {
+	expiry := mqtt.SessionExpiry(cp)
+
+	session, ok := mqtt.Sessions.Get(cp.ClientID)
+	if ok && !cp.CleanStartFlag {
+		// The expiry interval of the new connection replaces the old one.
+		session.SetExpiry(expiry)
+		return session, true
+	}
+	if ok {
+		if err := mqtt.EndSession(session); err != nil {
+			log.Println(err)
+		}
+	}
+
+	session = mqtt.newSession(cp.ClientID)
+	session.SetExpiry(expiry)
+	mqtt.Sessions.Put(cp.ClientID, session)
+	return session, false
+}
+
+// EndSession discards a session along with its subscriptions and queued messages.
+func (mqtt *MQTT) EndSession(s *Session) error {
+	mqtt.Subscriptions.RemoveClient(s.ClientID)
+	mqtt.Sessions.Delete(s.ClientID)
+	if !s.Persistent() {
+		return nil
+	}
+	return mqtt.DeleteStored(s.ClientID)
+}
+
+// DeleteStored removes the subscriptions and queued messages stored for a client.
+func (mqtt *MQTT) DeleteStored(clientID string) error {
+	if err := mqtt.SubscriptionService.DeleteByClientID(clientID); err != nil {
+		return err
+	}
+	return mqtt.MessageService.DeleteByClientID(clientID)
+}
+
+// QueueOffline holds a message for a persistent session until its client
+// reconnects, storing it so it survives a broker restart.
+func (mqtt *MQTT) QueueOffline(s *Session, pp *packets.PublishPacket) error {
+	// Messages dropped from a full queue aren't stored either.
+	if err := s.Queue(pp); err != nil {
+		return err
+	}
+	return mqtt.MessageService.Create(&models.Message{
+		ClientID: s.ClientID,
+		Topic:    pp.TopicName,
+		QoS:      pp.Flags.QoS,
+		Retain:   pp.Flags.Retain,
+		Payload:  pp.Payload,
+	})
+}
+
+// newSession returns a session with the broker's limits.
+func (mqtt *MQTT) newSession(clientID string) *Session {
+	session := NewSession(clientID, mqtt.MaxInflight)
+	session.MaxQueued = mqtt.MaxQueued
+	return session
+}
+
+// restoredSession returns the client's session, creating an offline persistent
+// one with the given expiry interval if needed.
+func (mqtt *MQTT) restoredSession(clientID string, expiry uint32) *Session {
+	session, ok := mqtt.Sessions.Get(clientID)
+	if !ok {
+		session = mqtt.newSession(clientID)
+		session.SetExpiry(expiry)
+		mqtt.Sessions.Put(clientID, session)
+	}
+	return session
+}
+
+// RestoreSessions rebuilds persistent sessions from their stored
+// subscriptions and queued messages, so they keep receiving messages
+// before their clients reconnect. Sessions keep the expiry interval their
+// client connected with.
+func (mqtt *MQTT) RestoreSessions() error {
+	stored, err := mqtt.SessionService.All()
+	if err != nil {
+		return err
+	}
+	expiries := make(map[string]uint32, len(stored))
+	for _, session := range stored {
+		expiries[session.ClientID] = session.ExpiryInterval
+	}
+	// Sessions missing from the table, or stored without an interval, get the broker default.
+	expiry := func(clientID string) uint32 {
+		if expiry, ok := expiries[clientID]; ok && expiry > 0 {
+			return expiry
+		}
+		return mqtt.SessionExpiryInterval
+	}
+
+	subscriptions, err := mqtt.SubscriptionService.All()
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		mqtt.Subscriptions.Subscribe(&Subscription{
+			Session: mqtt.restoredSession(subscription.ClientID, expiry(subscription.ClientID)),
+			Filter:  subscription.Filter,
+			QoS:     subscription.QoS,
+		})
+	}
+
+	messages, err := mqtt.MessageService.All()
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		flags := packets.FixedHeaderFlags{QoS: message.QoS, Retain: message.Retain}
+		err := mqtt.restoredSession(message.ClientID, expiry(message.ClientID)).Queue(packets.Publish(message.Topic, message.Payload, flags, 0))
+		if err != nil {
+			log.Printf("Message for %s dropped: %v", message.ClientID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+type memorySubscriptions map[string]models.Subscription
+
+func (ms memorySubscriptions) Create(subscription *models.Subscription) error {
+	ms[subscription.ClientID+" "+subscription.Filter] = *subscription
+	return nil
+}
+
+func (ms memorySubscriptions) Delete(clientID string, filter string) error {
+	delete(ms, clientID+" "+filter)
+	return nil
+}
+
+func (ms memorySubscriptions) DeleteByClientID(clientID string) error {
+	for key, subscription := range ms {
+		if subscription.ClientID == clientID {
+			delete(ms, key)
+		}
+	}
+	return nil
+}
+
+func (ms memorySubscriptions) All() ([]models.Subscription, error) {
+	var subscriptions []models.Subscription
+	for _, subscription := range ms {
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+type memoryMessages struct {
+	messages []models.Message
+}
+
+func (mm *memoryMessages) Create(message *models.Message) error {
+	mm.messages = append(mm.messages, *message)
+	return nil
+}
+
+func (mm *memoryMessages) All() ([]models.Message, error) {
+	return mm.messages, nil
+}
+
+func (mm *memoryMessages) DeleteByClientID(clientID string) error {
+	var kept []models.Message
+	for _, message := range mm.messages {
+		if message.ClientID != clientID {
+			kept = append(kept, message)
+		}
+	}
+	mm.messages = kept
+	return nil
+}
+
+// memorySessions is safe for concurrent use, connections end on their own goroutines.
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]models.Session
+}
+
+func (ms *memorySessions) Create(session *models.Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.sessions == nil {
+		ms.sessions = make(map[string]models.Session)
+	}
+	ms.sessions[session.ClientID] = *session
+	return nil
+}
+
+func (ms *memorySessions) Expire(clientID string, expiresAt *time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.sessions == nil {
+		ms.sessions = make(map[string]models.Session)
+	}
+	session := ms.sessions[clientID]
+	session.ExpiresAt = expiresAt
+	ms.sessions[clientID] = session
+	return nil
+}
+
+func (ms *memorySessions) Expired(now time.Time) ([]models.Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var sessions []models.Session
+	for _, session := range ms.sessions {
+		if session.ExpiresAt != nil && !session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (ms *memorySessions) All() ([]models.Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var sessions []models.Session
+	for _, session := range ms.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (ms *memorySessions) Delete(clientID string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, clientID)
+	return nil
+}
+
+// testBroker returns a broker backed by in memory services, shared by the server tests.
+func testBroker() *MQTT {
+	return &MQTT{
+		Services: models.Services{
+			SessionService:      &memorySessions{},
+			SubscriptionService: memorySubscriptions{},
+			MessageService:      &memoryMessages{},
+		},
+		Subscriptions:         NewSubscriptionRegistry(),
+		Sessions:              NewSessionStore(),
+		Connections:           NewConnectionRegistry(),
+		MaxInflight:           DefaultMaxInflight,
+		SessionExpiryInterval: DefaultSessionExpiryInterval,
+		wills:                 newPendingWills(),
+	}
+}
+
+func TestPersistentSessionQueuesWhileOffline(t *testing.T) {
+	mqtt := testBroker()
+
+	session, present := mqtt.ResumeSession(&packets.ConnectPacket{ClientID: "sensor"})
+	if present {
+		t.Fatal("new session reported as present")
+	}
+	sensor, _ := pipeConnection("sensor")
+	sensor.Session = session
+	session.Attach(sensor)
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: session, Filter: "commands/sensor", QoS: 1})
+
+	// Sensor goes to sleep, the session and its subscription stay.
+	mqtt.CloseConnection(sensor)
+	if got := mqtt.Subscriptions.Count(); got != 1 {
+		t.Fatalf("subscriptions after disconnect = %d, want 1", got)
+	}
+
+	for _, qos := range []byte{0, 1} {
+		err := mqtt.HandlePublish(packets.Publish("commands/sensor", []byte{'0' + qos}, packets.FixedHeaderFlags{QoS: qos}, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := mqtt.MessageService.All(); len(got) != 1 {
+		t.Fatalf("stored messages = %d, want 1", len(got))
+	}
+
+	resumed, present := mqtt.ResumeSession(&packets.ConnectPacket{ClientID: "sensor"})
+	if !present || resumed != session {
+		t.Fatal("persistent session was not resumed")
+	}
+	sensor, sensorClient := pipeConnection("sensor")
+	sensor.Session = resumed
+	resumed.Attach(sensor)
+
+	errs := make(chan error, 1)
+	go func() { errs <- mqtt.Retransmit(sensor) }()
+	// Only the QoS 1 command was queued.
+	expectBytes(t, sensorClient, []byte{0x32, 20, 0, 15, 'c', 'o', 'm', 'm', 'a', 'n', 'd', 's', '/', 's', 'e', 'n', 's', 'o', 'r', 0, 1, '1'})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mqtt.MessageService.All(); len(got) != 0 {
+		t.Errorf("stored messages after replay = %d, want 0", len(got))
+	}
+}
+
+func TestOfflineQueueLimit(t *testing.T) {
+	mqtt := testBroker()
+	mqtt.MaxQueued = 2
+	session, _ := mqtt.ResumeSession(&packets.ConnectPacket{ClientID: "sensor"})
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: session, Filter: "commands/sensor", QoS: 1})
+
+	for i := 0; i < 2; i++ {
+		if _, err := mqtt.publish(packets.Publish("commands/sensor", nil, packets.FixedHeaderFlags{QoS: 1}, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The full queue refuses the next message, telling an MQTT 5 publisher.
+	publisher, publisherClient := pipeConnection("publisher")
+	publisher.ProtocolVersion = packets.MQTT5
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mqtt.ReceivePublish(packets.Publish("commands/sensor", nil, packets.FixedHeaderFlags{QoS: 1}, 5), publisher)
+	}()
+	expectBytes(t, publisherClient, append([]byte{0x40, 21, 0, 5, packets.QuotaExceeded, 17, packets.ReasonStringIdentifier, 0, 14}, "Quota exceeded"...))
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := mqtt.MessageService.All(); len(got) != 2 {
+		t.Errorf("stored messages = %d, want 2", len(got))
+	}
+	if got := len(session.pending); got != 2 {
+		t.Errorf("queued messages = %d, want 2", got)
+	}
+}
+
+func TestRestoreSessionsKeepsExpiry(t *testing.T) {
+	mqtt := testBroker()
+	mqtt.SessionService.Create(&models.Session{ClientID: "sensor", ExpiryInterval: 60})
+	mqtt.SubscriptionService.Create(&models.Subscription{ClientID: "sensor", Filter: "commands/sensor", QoS: 1})
+	mqtt.SubscriptionService.Create(&models.Subscription{ClientID: "meter", Filter: "commands/meter", QoS: 1})
+	if err := mqtt.RestoreSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		clientID string
+		want     uint32
+	}{
+		{"sensor", 60},
+		{"meter", DefaultSessionExpiryInterval},
+	}
+	for _, tt := range tests {
+		session, ok := mqtt.Sessions.Get(tt.clientID)
+		if !ok {
+			t.Fatalf("%s not restored", tt.clientID)
+		}
+		if got := session.Expiry(); got != tt.want {
+			t.Errorf("%s Expiry() = %d, want %d", tt.clientID, got, tt.want)
+		}
+	}
+}
+
+func TestCleanStartDiscardsSession(t *testing.T) {
+	mqtt := testBroker()
+	mqtt.SubscriptionService.Create(&models.Subscription{ClientID: "sensor", Filter: "commands/sensor", QoS: 1})
+	mqtt.MessageService.Create(&models.Message{ClientID: "sensor", Topic: "commands/sensor", QoS: 1})
+	if err := mqtt.RestoreSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	session, present := mqtt.ResumeSession(&packets.ConnectPacket{ClientID: "sensor", CleanStartFlag: true})
+	if present {
+		t.Error("clean start reported session as present")
+	}
+	if session.Persistent() {
+		t.Error("clean start session is persistent")
+	}
+	if got := mqtt.Subscriptions.Count(); got != 0 {
+		t.Errorf("subscriptions after clean start = %d, want 0", got)
+	}
+	if got, _ := mqtt.SubscriptionService.All(); len(got) != 0 {
+		t.Errorf("stored subscriptions after clean start = %d, want 0", len(got))
+	}
+	if got, _ := mqtt.MessageService.All(); len(got) != 0 {
+		t.Errorf("stored messages after clean start = %d, want 0", len(got))
+	}
+}
+
+func TestReapSessions(t *testing.T) {
+	mqtt := testBroker()
+
+	cp := &packets.ConnectPacket{ClientID: "sensor", ProtocolVersion: packets.MQTT5, SessionExpiryInterval: 60}
+	mqtt.SessionService.Create(&models.Session{ClientID: "sensor", ExpiryInterval: 60})
+	session, _ := mqtt.ResumeSession(cp)
+	sensor, _ := pipeConnection("sensor")
+	sensor.Session = session
+	session.Attach(sensor)
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: session, Filter: "commands/sensor", QoS: 1})
+	mqtt.SubscriptionService.Create(&models.Subscription{ClientID: "sensor", Filter: "commands/sensor", QoS: 1})
+
+	mqtt.CloseConnection(sensor)
+
+	// Not yet expired.
+	if err := mqtt.ReapSessions(time.Now().Add(30 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mqtt.Sessions.Get("sensor"); !ok {
+		t.Fatal("session reaped before it expired")
+	}
+
+	if err := mqtt.ReapSessions(time.Now().Add(61 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mqtt.Sessions.Get("sensor"); ok {
+		t.Error("expired session still held")
+	}
+	if got := mqtt.Subscriptions.Count(); got != 0 {
+		t.Errorf("subscriptions after expiry = %d, want 0", got)
+	}
+	if got, _ := mqtt.SubscriptionService.All(); len(got) != 0 {
+		t.Errorf("stored subscriptions after expiry = %d, want 0", len(got))
+	}
+	if got, _ := mqtt.SessionService.Expired(time.Now().Add(time.Hour)); len(got) != 0 {
+		t.Errorf("stored sessions after expiry = %d, want 0", len(got))
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	mqtt := &MQTT{SessionExpiryInterval: 100}
+
+	tests := []struct {
+		name string
+		cp   *packets.ConnectPacket
+		want uint32
+	}{
+		{name: "MQTT 3.1.1 clean session", cp: &packets.ConnectPacket{ProtocolVersion: packets.MQTT311, CleanStartFlag: true}, want: 0},
+		{name: "MQTT 3.1.1 persistent session", cp: &packets.ConnectPacket{ProtocolVersion: packets.MQTT311}, want: 100},
+		{name: "MQTT 5 expiry interval", cp: &packets.ConnectPacket{ProtocolVersion: packets.MQTT5, SessionExpiryInterval: 5}, want: 5},
+		{name: "MQTT 5 no expiry interval", cp: &packets.ConnectPacket{ProtocolVersion: packets.MQTT5}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mqtt.SessionExpiry(tt.cp); got != tt.want {
+				t.Errorf("SessionExpiry() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
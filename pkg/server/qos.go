@@ -0,0 +1,170 @@
+package server
+
+import (
+	"log"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// ReceivePublish acknowledges an inbound PUBLISH according to its QoS and
+// hands it on for delivery. QoS 2 messages are delivered on first receipt
+// and their packet identifier held until PUBREL, so retransmissions are
+// acknowledged again without being delivered twice.
+func (mqtt *MQTT) ReceivePublish(pp *packets.PublishPacket, c *Connection) error {
+	switch pp.Flags.QoS {
+	case 0:
+		_, err := mqtt.publishFrom(pp, c)
+		// QoS 0 has no acknowledgement to refuse the message with.
+		switch err {
+		case ErrNotAuthorised:
+			log.Printf("%s not authorised to publish to %s", c.ClientID, pp.TopicName)
+			return nil
+		case ErrQueueFull:
+			// Already logged for each subscriber.
+			return nil
+		}
+		return err
+	case 1:
+		rc, err := publishReasonCode(mqtt.publishFrom(pp, c))
+		if err != nil && c.ProtocolVersion < packets.MQTT5 {
+			return err
+		}
+		return c.WritePacket(withReason(packets.Acknowledge(pp.PacketIdentifier), rc, c))
+	case 2:
+		rc := byte(packets.Success)
+		if c.Session.Receive(pp.PacketIdentifier) {
+			var err error
+			rc, err = publishReasonCode(mqtt.publishFrom(pp, c))
+			// Failed messages weren't delivered, a retry can be.
+			if packets.Failed(rc) {
+				c.Session.Release(pp.PacketIdentifier)
+			}
+			if err != nil && c.ProtocolVersion < packets.MQTT5 {
+				return err
+			}
+		} else {
+			log.Printf("Duplicate QoS 2 publish %d from %s", pp.PacketIdentifier, c.ClientID)
+		}
+		return c.WritePacket(withReason(packets.Received(pp.PacketIdentifier), rc, c))
+	}
+	// Both QoS bits set isn't a valid QoS.
+	return malformed(packets.ErrMalformedPacket)
+}
+
+// publishReasonCode gives the reason code acknowledging a publish, older
+// clients can't be told about failures and get the error instead. Messages
+// the client wasn't authorised to publish, or no subscriber had room to
+// queue, are dropped, older clients are acknowledged as usual.
+func publishReasonCode(matched int, err error) (byte, error) {
+	switch {
+	case err == ErrNotAuthorised:
+		return packets.NotAuthorized, nil
+	case err == ErrQueueFull:
+		return packets.QuotaExceeded, nil
+	case err == ErrTopicNameInvalid:
+		return packets.TopicNameInvalid, err
+	case err != nil:
+		log.Println(err)
+		return packets.UnspecifiedError, err
+	case matched == 0:
+		return packets.NoMatchingSubscribers, nil
+	}
+	return packets.Success, nil
+}
+
+// withReason sets the reason code of an acknowledgement, explaining it if the client wants problem information.
+func withReason(pq *packets.PublishQoSPacket, rc byte, c *Connection) *packets.PublishQoSPacket {
+	pq.ReasonCode = rc
+	pq.Properties = c.ReasonProperties(rc)
+	return pq
+}
+
+// logFailure records acknowledgements where the client reports a failure.
+func logFailure(pq *packets.PublishQoSPacket, c *Connection) {
+	if packets.Failed(pq.ReasonCode) {
+		log.Printf("%s reported %s for packet identifier %d", c.ClientID, packets.ReasonString(pq.ReasonCode), pq.PacketIdentifier.PacketIdentifier)
+	}
+}
+
+// HandlePubRel completes an inbound QoS 2 flow.
+func (mqtt *MQTT) HandlePubRel(pq *packets.PublishQoSPacket, c *Connection) error {
+	pi := pq.PacketIdentifier.PacketIdentifier
+	rc := byte(packets.Success)
+	if !c.Session.Release(pi) {
+		log.Printf("PUBREL for unknown packet identifier %d from %s", pi, c.ClientID)
+		rc = packets.PacketIdentifierNotFound
+	}
+	// PUBCOMP is sent regardless, the client may be retrying after we've already released.
+	return c.WritePacket(withReason(packets.Complete(pi), rc, c))
+}
+
+// HandlePubAck completes an outbound QoS 1 flow.
+func (mqtt *MQTT) HandlePubAck(pq *packets.PublishQoSPacket, c *Connection) error {
+	pi := pq.PacketIdentifier.PacketIdentifier
+	logFailure(pq, c)
+	if !c.Session.Acknowledge(pi) {
+		log.Printf("PUBACK for unknown packet identifier %d from %s", pi, c.ClientID)
+	}
+	return mqtt.SendPending(c)
+}
+
+// HandlePubRec releases an outbound QoS 2 message the client has received.
+// A client that rejects the message ends the flow without a PUBREL.
+func (mqtt *MQTT) HandlePubRec(pq *packets.PublishQoSPacket, c *Connection) error {
+	pi := pq.PacketIdentifier.PacketIdentifier
+	if packets.Failed(pq.ReasonCode) {
+		logFailure(pq, c)
+		c.Session.Discard(pi)
+		return mqtt.SendPending(c)
+	}
+
+	rc := byte(packets.Success)
+	if !c.Session.Received(pi) {
+		log.Printf("PUBREC for unknown packet identifier %d from %s", pi, c.ClientID)
+		rc = packets.PacketIdentifierNotFound
+	}
+	return c.WritePacket(withReason(packets.Release(pi), rc, c))
+}
+
+// HandlePubComp finishes an outbound QoS 2 flow.
+func (mqtt *MQTT) HandlePubComp(pq *packets.PublishQoSPacket, c *Connection) error {
+	pi := pq.PacketIdentifier.PacketIdentifier
+	logFailure(pq, c)
+	if !c.Session.Complete(pi) {
+		log.Printf("PUBCOMP for unknown packet identifier %d from %s", pi, c.ClientID)
+	}
+	return mqtt.SendPending(c)
+}
+
+// SendPending writes queued messages as the inflight window frees up.
+func (mqtt *MQTT) SendPending(c *Connection) error {
+	for {
+		pp, err := c.Session.Next()
+		if err != nil || pp == nil {
+			return err
+		}
+		if err := c.WritePacket(pp); err != nil {
+			return err
+		}
+	}
+}
+
+// Retransmit resends every unacknowledged outbound message on a resumed
+// session, followed by anything queued behind the inflight window or while
+// the client was offline.
+func (mqtt *MQTT) Retransmit(c *Connection) error {
+	for _, p := range c.Session.Inflight() {
+		if err := c.WritePacket(p); err != nil {
+			return err
+		}
+	}
+	if err := mqtt.SendPending(c); err != nil {
+		return err
+	}
+
+	// Queued messages are now held by the session, they no longer need to be stored.
+	if c.Session.Persistent() {
+		return mqtt.MessageService.DeleteByClientID(c.ClientID)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+func pipeConnection(clientID string) (*Connection, net.Conn) {
+	server, client := net.Pipe()
+	c := &Connection{
+		ClientID:        clientID,
+		ProtocolVersion: packets.MQTT311,
+		Conn:            server,
+		Session:         NewSession(clientID, DefaultMaxInflight),
+	}
+	c.Session.Attach(c)
+	return c, client
+}
+
+func expectBytes(t *testing.T, r io.Reader, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("reading %d bytes: %v", len(want), err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %v, want %v", got, want)
+	}
+}
+
+func TestReceivePublishQoS2DeliversOnce(t *testing.T) {
+	mqtt := &MQTT{Subscriptions: NewSubscriptionRegistry()}
+
+	publisher, publisherClient := pipeConnection("publisher")
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: subscriber.Session, Filter: "billing/#", QoS: 2})
+
+	pp := packets.Publish("billing/1", []byte("x"), packets.FixedHeaderFlags{QoS: 2}, 9)
+
+	errs := make(chan error, 1)
+	go func() { errs <- mqtt.ReceivePublish(pp, publisher) }()
+	// Subscriber gets the message, publisher gets PUBREC.
+	expectBytes(t, subscriberClient, []byte{0x34, 14, 0, 9, 'b', 'i', 'l', 'l', 'i', 'n', 'g', '/', '1', 0, 1, 'x'})
+	expectBytes(t, publisherClient, []byte{0x50, 2, 0, 9})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// A retransmission is acknowledged without another delivery.
+	pp.Flags.Duplicate = true
+	go func() { errs <- mqtt.ReceivePublish(pp, publisher) }()
+	expectBytes(t, publisherClient, []byte{0x50, 2, 0, 9})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { errs <- mqtt.HandlePubRel(packets.Release(9), publisher) }()
+	expectBytes(t, publisherClient, []byte{0x70, 2, 0, 9})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if publisher.Session.Release(9) {
+		t.Error("packet identifier still held after PUBREL")
+	}
+}
+
+func TestReceivePublishQoS3(t *testing.T) {
+	mqtt := &MQTT{Subscriptions: NewSubscriptionRegistry()}
+	publisher, _ := pipeConnection("publisher")
+
+	err := mqtt.ReceivePublish(packets.Publish("a", nil, packets.FixedHeaderFlags{QoS: 3}, 1), publisher)
+	de, ok := err.(*DisconnectError)
+	if !ok || de.ReasonCode != packets.MalformedPacket {
+		t.Errorf("ReceivePublish() error = %v, want malformed packet", err)
+	}
+}
+
+func TestDeliverWhileHeld(t *testing.T) {
+	mqtt := &MQTT{}
+	c, client := pipeConnection("subscriber")
+	c.Session.Hold(c)
+
+	// Nothing reads from the client yet, writing would block.
+	for _, qos := range []byte{0, 1} {
+		if err := mqtt.Deliver(c.Session, "a", []byte{'0' + qos}, qos, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(c.Session.Inflight()); got != 0 {
+		t.Fatalf("inflight while held = %d, want 0", got)
+	}
+
+	c.Session.Attach(c)
+	errs := make(chan error, 1)
+	go func() { errs <- mqtt.SendPending(c) }()
+	// Only the QoS 1 message was queued, and it's sent once without DUP.
+	expectBytes(t, client, []byte{0x32, 6, 0, 1, 'a', 0, 1, '1'})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboundQoS2Flow(t *testing.T) {
+	mqtt := &MQTT{Subscriptions: NewSubscriptionRegistry()}
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	if _, err := subscriber.Session.Send(packets.Publish("billing/1", nil, packets.FixedHeaderFlags{QoS: 2}, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- mqtt.HandlePubRec(packets.Received(1), subscriber) }()
+	expectBytes(t, subscriberClient, []byte{0x62, 2, 0, 1})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mqtt.HandlePubComp(packets.Complete(1), subscriber); err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriber.Session.outbound) != 0 {
+		t.Errorf("outbound messages after PUBCOMP = %d, want 0", len(subscriber.Session.outbound))
+	}
+}
+
+func TestHandlePublishDowngradesQoS(t *testing.T) {
+	mqtt := &MQTT{Subscriptions: NewSubscriptionRegistry()}
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: subscriber.Session, Filter: "a", QoS: 1})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mqtt.HandlePublish(packets.Publish("a", []byte("x"), packets.FixedHeaderFlags{QoS: 2}, 40))
+	}()
+	// Delivered at QoS 1 with the subscriber's own packet identifier.
+	expectBytes(t, subscriberClient, []byte{0x32, 6, 0, 1, 'a', 0, 1, 'x'})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mqtt.HandlePubAck(packets.Acknowledge(1), subscriber); err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriber.Session.outbound) != 0 {
+		t.Errorf("outbound messages after PUBACK = %d, want 0", len(subscriber.Session.outbound))
+	}
+}
+
+func TestSessionPacketIdentifierAllocation(t *testing.T) {
+	s := NewSession("a", DefaultMaxInflight)
+	s.lastPacketIdentifier = 65534
+	s.outbound[1] = &outboundMessage{}
+
+	var got []uint16
+	for i := 0; i < 3; i++ {
+		pp := packets.Publish("a", nil, packets.FixedHeaderFlags{QoS: 1}, 0)
+		if _, err := s.Send(pp); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, pp.PacketIdentifier)
+	}
+
+	// Wraps past 65535, skipping zero and identifiers still in flight.
+	want := []uint16{65535, 2, 3}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("allocated %v, want %v", got, want)
+		}
+	}
+}
+
+func TestInflightWindowQueuesAndRetransmits(t *testing.T) {
+	mqtt := &MQTT{Subscriptions: NewSubscriptionRegistry()}
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	subscriber.Session = NewSession("subscriber", 2)
+	subscriber.Session.Attach(subscriber)
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: subscriber.Session, Filter: "a", QoS: 2})
+
+	errs := make(chan error, 1)
+	go func() {
+		for _, qos := range []byte{1, 2, 1} {
+			if err := mqtt.HandlePublish(packets.Publish("a", nil, packets.FixedHeaderFlags{QoS: qos}, 0)); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	// Only two messages fit in the window, the third is queued.
+	expectBytes(t, subscriberClient, []byte{0x32, 5, 0, 1, 'a', 0, 1})
+	expectBytes(t, subscriberClient, []byte{0x34, 5, 0, 1, 'a', 0, 2})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscriber reconnects having received the QoS 2 message only.
+	subscriber.Session.Received(2)
+	go func() { errs <- mqtt.Retransmit(subscriber) }()
+	expectBytes(t, subscriberClient, []byte{0x3A, 5, 0, 1, 'a', 0, 1})
+	expectBytes(t, subscriberClient, []byte{0x62, 2, 0, 2})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// Acknowledging the first message lets the queued one through.
+	go func() { errs <- mqtt.HandlePubAck(packets.Acknowledge(1), subscriber) }()
+	expectBytes(t, subscriberClient, []byte{0x32, 5, 0, 1, 'a', 0, 3})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishReasonCodes(t *testing.T) {
+	reason := func(s string) []byte {
+		return append([]byte{byte(len(s) + 3), packets.ReasonStringIdentifier, 0, byte(len(s))}, s...)
+	}
+	tests := []struct {
+		name    string
+		version byte
+		topic   string
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:    "MQTT 5 invalid topic",
+			version: packets.MQTT5,
+			topic:   "a/#",
+			want:    append([]byte{0x40, 25, 0, 5, packets.TopicNameInvalid}, reason("Topic Name invalid")...),
+		},
+		{
+			name:    "MQTT 5 no subscribers",
+			version: packets.MQTT5,
+			topic:   "nobody/listening",
+			want:    append([]byte{0x40, 30, 0, 5, packets.NoMatchingSubscribers}, reason("No matching subscribers")...),
+		},
+		{
+			name:    "MQTT 3.1.1 no subscribers",
+			version: packets.MQTT311,
+			topic:   "nobody/listening",
+			want:    []byte{0x40, 2, 0, 5},
+		},
+		{
+			name:    "MQTT 3.1.1 invalid topic",
+			version: packets.MQTT311,
+			topic:   "a/#",
+			wantErr: ErrTopicNameInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := &MQTT{Subscriptions: NewSubscriptionRegistry()}
+			publisher, publisherClient := pipeConnection("publisher")
+			publisher.ProtocolVersion = tt.version
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- mqtt.ReceivePublish(packets.Publish(tt.topic, nil, packets.FixedHeaderFlags{QoS: 1}, 5), publisher)
+			}()
+			if tt.want != nil {
+				expectBytes(t, publisherClient, tt.want)
+			}
+			if err := <-errs; err != tt.wantErr {
+				t.Errorf("ReceivePublish() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
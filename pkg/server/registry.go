@@ -0,0 +1,120 @@
+package server
+
+import "sync"
+
+// SubscriptionRegistry is the broker's concurrency safe store of subscriptions.
+// It indexes subscriptions both by topic filter, for matching publishes, and
+// by client, so a client's subscriptions can be listed and removed together.
+type SubscriptionRegistry struct {
+	mu      sync.RWMutex
+	trie    *TopicTrie
+	clients map[string]map[string]*Subscription // ClientID -> Filter -> Subscription
+}
+
+func NewSubscriptionRegistry() *SubscriptionRegistry {
+	return &SubscriptionRegistry{
+		trie:    NewTopicTrie(),
+		clients: make(map[string]map[string]*Subscription),
+	}
+}
+
+// Subscribe adds or replaces a subscription, reporting whether the client
+// was already subscribed to the filter.
+func (r *SubscriptionRegistry) Subscribe(s *Subscription) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	filters, ok := r.clients[s.Session.ClientID]
+	if !ok {
+		filters = make(map[string]*Subscription)
+		r.clients[s.Session.ClientID] = filters
+	}
+	_, existing := filters[s.Filter]
+	filters[s.Filter] = s
+	r.trie.Insert(s)
+	return existing
+}
+
+// Unsubscribe removes a client's subscription to filter, returning false if
+// the client was not subscribed to it.
+func (r *SubscriptionRegistry) Unsubscribe(clientID string, filter string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	filters, ok := r.clients[clientID]
+	if !ok {
+		return false
+	}
+	if _, ok := filters[filter]; !ok {
+		return false
+	}
+	delete(filters, filter)
+	if len(filters) == 0 {
+		delete(r.clients, clientID)
+	}
+	return r.trie.Remove(filter, clientID)
+}
+
+// RemoveClient removes all of a client's subscriptions, returning how many were removed.
+func (r *SubscriptionRegistry) RemoveClient(clientID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	filters := r.clients[clientID]
+	for filter := range filters {
+		r.trie.Remove(filter, clientID)
+	}
+	delete(r.clients, clientID)
+	return len(filters)
+}
+
+// Match returns the subscriptions matching a topic name, one per client.
+func (r *SubscriptionRegistry) Match(topic string) []*Subscription {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.trie.Match(topic)
+}
+
+// ClientSubscriptions lists the subscriptions held by a client.
+func (r *SubscriptionRegistry) ClientSubscriptions(clientID string) []*Subscription {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	filters := r.clients[clientID]
+	subscriptions := make([]*Subscription, 0, len(filters))
+	for _, s := range filters {
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions
+}
+
+// Clients lists the IDs of every client holding at least one subscription.
+func (r *SubscriptionRegistry) Clients() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]string, 0, len(r.clients))
+	for clientID := range r.clients {
+		clients = append(clients, clientID)
+	}
+	return clients
+}
+
+// Count returns the total number of subscriptions across all clients.
+func (r *SubscriptionRegistry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var count int
+	for _, filters := range r.clients {
+		count += len(filters)
+	}
+	return count
+}
+
+// ClientCount returns the number of clients holding at least one subscription.
+func (r *SubscriptionRegistry) ClientCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.clients)
+}
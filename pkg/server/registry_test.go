@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSubscriptionRegistryRemoveClient(t *testing.T) {
+	a := NewSession("a", 0)
+	b := NewSession("b", 0)
+
+	r := NewSubscriptionRegistry()
+	r.Subscribe(&Subscription{Session: a, Filter: "site/+/telemetry"})
+	r.Subscribe(&Subscription{Session: a, Filter: "site/#"})
+	r.Subscribe(&Subscription{Session: b, Filter: "site/#"})
+
+	if got := r.Count(); got != 3 {
+		t.Fatalf("Count() = %d, want 3", got)
+	}
+	if got := r.RemoveClient("a"); got != 2 {
+		t.Errorf("RemoveClient() = %d, want 2", got)
+	}
+	if got := r.ClientSubscriptions("a"); len(got) != 0 {
+		t.Errorf("ClientSubscriptions() after RemoveClient() = %d, want 0", len(got))
+	}
+	if got := matchedClients(r.Match("site/1/telemetry")); len(got) != 1 || got[0] != "b" {
+		t.Errorf("Match() after RemoveClient() = %v, want [b]", got)
+	}
+	if got := r.ClientCount(); got != 1 {
+		t.Errorf("ClientCount() = %d, want 1", got)
+	}
+}
+
+func TestSubscriptionRegistryConcurrentAccess(t *testing.T) {
+	r := NewSubscriptionRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := NewSession(fmt.Sprintf("client-%d", i), 0)
+			for j := 0; j < 100; j++ {
+				filter := fmt.Sprintf("site/%d/#", j%10)
+				r.Subscribe(&Subscription{Session: c, Filter: filter})
+				r.Match(fmt.Sprintf("site/%d/telemetry", j%10))
+				r.Unsubscribe(c.ClientID, filter)
+			}
+			r.RemoveClient(c.ClientID)
+		}(i)
+	}
+	wg.Wait()
+
+	if got := r.Count(); got != 0 {
+		t.Errorf("Count() = %d, want 0", got)
+	}
+}
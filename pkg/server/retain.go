@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// HandleRetain stores a PUBLISH with the retain flag set as the topic's
+// retained message. A zero length payload clears the retained message.
+func (mqtt *MQTT) HandleRetain(pp *packets.PublishPacket) error {
+	if len(pp.Payload) == 0 {
+		return mqtt.RetainService.Delete(pp.TopicName)
+	}
+	return mqtt.RetainService.Set(&models.Retain{
+		Topic:   pp.TopicName,
+		QoS:     pp.Flags.QoS,
+		Payload: pp.Payload,
+	})
+}
+
+// SendRetained delivers the retained messages matching a new subscription,
+// at the lower of the retained and granted QoS.
+func (mqtt *MQTT) SendRetained(c *Connection, filter string, granted byte) error {
+	retains, err := mqtt.RetainService.Match(filter)
+	if err != nil {
+		return err
+	}
+
+	for _, retain := range retains {
+		// Matching the filter isn't enough, each retained topic must be readable.
+		if mqtt.authorize(c, RetainedReadAction, retain.Topic) != nil {
+			continue
+		}
+		qos := retain.QoS
+		if granted < qos {
+			qos = granted
+		}
+		if err := mqtt.Deliver(c.Session, retain.Topic, retain.Payload, qos, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
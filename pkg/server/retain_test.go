@@ -0,0 +1,78 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+	"github.com/naspinall/Hive-MQTT/pkg/topics"
+)
+
+type memoryRetain map[string]models.Retain
+
+func (mr memoryRetain) Set(retain *models.Retain) error {
+	mr[retain.Topic] = *retain
+	return nil
+}
+
+func (mr memoryRetain) Delete(topic string) error {
+	delete(mr, topic)
+	return nil
+}
+
+func (mr memoryRetain) All() ([]models.Retain, error) {
+	return mr.Match("#")
+}
+
+func (mr memoryRetain) Match(filter string) ([]models.Retain, error) {
+	var retains []models.Retain
+	for topic, retain := range mr {
+		if topics.Match(filter, topic) {
+			retains = append(retains, retain)
+		}
+	}
+	return retains, nil
+}
+
+func TestRetainedMessageDeliveredOnSubscribe(t *testing.T) {
+	retained := memoryRetain{}
+	mqtt := &MQTT{
+		Services:      models.Services{RetainService: retained},
+		Subscriptions: NewSubscriptionRegistry(),
+	}
+
+	err := mqtt.HandlePublish(packets.Publish("site/1/config", []byte("x"), packets.FixedHeaderFlags{QoS: 1, Retain: true}, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := retained["site/1/config"]; !ok {
+		t.Fatal("retained message was not stored")
+	}
+
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	sp := &packets.SubscribePacket{Topics: []packets.Topic{{Topic: "site/+/config", QoS: 0}}}
+	sp.PacketIdentifier.PacketIdentifier = 2
+
+	done := make(chan struct{})
+	go func() {
+		mqtt.HandleSubscribe(sp, subscriber)
+		close(done)
+	}()
+	expectBytes(t, subscriberClient, []byte{0x90, 3, 0, 2, 0})
+	// Delivered at the granted QoS with the retain flag set.
+	expectBytes(t, subscriberClient, []byte{0x31, 16, 0, 13, 's', 'i', 't', 'e', '/', '1', '/', 'c', 'o', 'n', 'f', 'i', 'g', 'x'})
+	<-done
+
+	// An empty retained publish clears the topic, existing subscribers get it without the retain flag.
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mqtt.HandlePublish(packets.Publish("site/1/config", nil, packets.FixedHeaderFlags{Retain: true}, 0))
+	}()
+	expectBytes(t, subscriberClient, []byte{0x30, 15, 0, 13, 's', 'i', 't', 'e', '/', '1', '/', 'c', 'o', 'n', 'f', 'i', 'g'})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := retained["site/1/config"]; ok {
+		t.Error("retained message was not cleared")
+	}
+}
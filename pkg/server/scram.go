@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+)
+
+const ScramSHA256Method = "SCRAM-SHA-256"
+
+var (
+	ErrScramMessage        = errors.New("Invalid SCRAM message")
+	ErrScramChannelBinding = errors.New("SCRAM channel binding is not supported")
+)
+
+// ScramSHA256 authenticates clients with SCRAM-SHA-256 (RFC 7677), proving
+// they know the password without it being sent to the server.
+type ScramSHA256 struct {
+	Credentials models.ScramService
+	// Unknown usernames are given a salt derived from this key, so they look
+	// like any other user until the proof fails.
+	mockKey []byte
+}
+
+func NewScramSHA256(credentials models.ScramService) *ScramSHA256 {
+	mockKey := make([]byte, sha256.Size)
+	if _, err := rand.Read(mockKey); err != nil {
+		panic(err)
+	}
+	return &ScramSHA256{
+		Credentials: credentials,
+		mockKey:     mockKey,
+	}
+}
+
+func (s *ScramSHA256) Method() string {
+	return ScramSHA256Method
+}
+
+func (s *ScramSHA256) Start(clientID string) AuthExchange {
+	return &scramExchange{mechanism: s}
+}
+
+// credential looks up a user, unknown users get a credential no proof matches.
+func (s *ScramSHA256) credential(username string) (*models.ScramCredential, bool) {
+	credential, err := s.Credentials.ByUsername(username)
+	if err == nil {
+		return credential, true
+	}
+	return &models.ScramCredential{
+		Username:   username,
+		Salt:       hmacSHA256(s.mockKey, username)[:16],
+		Iterations: models.DefaultScramIterations,
+	}, false
+}
+
+type scramExchange struct {
+	mechanism *ScramSHA256
+	// Set once the client's first message has been read.
+	credential *models.ScramCredential
+	known      bool
+	done       bool
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+func (se *scramExchange) Step(data []byte) ([]byte, bool, error) {
+	if se.done {
+		return nil, false, ErrScramMessage
+	}
+	if se.credential == nil {
+		return se.clientFirst(string(data))
+	}
+	return se.clientFinal(string(data))
+}
+
+func (se *scramExchange) Username() string {
+	if !se.done {
+		return ""
+	}
+	return se.credential.Username
+}
+
+// clientFirst reads "n,,n=user,r=nonce" and challenges with the user's salt.
+func (se *scramExchange) clientFirst(message string) ([]byte, bool, error) {
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, ErrScramMessage
+	}
+	switch {
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, false, ErrScramChannelBinding
+	case parts[0] != "n" && parts[0] != "y":
+		return nil, false, ErrScramMessage
+	}
+	// Authorisation identities other than the user aren't supported.
+	if parts[1] != "" {
+		return nil, false, ErrScramMessage
+	}
+	se.gs2Header = parts[0] + "," + parts[1] + ","
+	se.clientFirstBare = parts[2]
+
+	attributes, err := scramAttributes(se.clientFirstBare)
+	if err != nil {
+		return nil, false, err
+	}
+	username, err := scramUnescape(attributes["n"])
+	if err != nil || username == "" || attributes["r"] == "" {
+		return nil, false, ErrScramMessage
+	}
+	// Mandatory extensions can't be ignored.
+	if _, ok := attributes["m"]; ok {
+		return nil, false, ErrScramMessage
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, false, err
+	}
+	se.nonce = attributes["r"] + base64.StdEncoding.EncodeToString(serverNonce)
+	se.credential, se.known = se.mechanism.credential(username)
+
+	se.serverFirst = "r=" + se.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(se.credential.Salt) +
+		",i=" + strconv.Itoa(se.credential.Iterations)
+	return []byte(se.serverFirst), false, nil
+}
+
+// clientFinal checks "c=biws,r=nonce,p=proof" and answers with the
+// server's signature so the client can verify the server too.
+func (se *scramExchange) clientFinal(message string) ([]byte, bool, error) {
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, false, ErrScramMessage
+	}
+	withoutProof := message[:i]
+	attributes, err := scramAttributes(withoutProof)
+	if err != nil {
+		return nil, false, err
+	}
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(se.gs2Header)) || attributes["r"] != se.nonce {
+		return nil, false, ErrScramMessage
+	}
+	proof, err := base64.StdEncoding.DecodeString(message[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, false, ErrScramMessage
+	}
+
+	authMessage := se.clientFirstBare + "," + se.serverFirst + "," + withoutProof
+	// ClientKey = ClientProof XOR HMAC(StoredKey, AuthMessage)
+	clientKey := hmacSHA256(se.credential.StoredKey, authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !se.known || !hmac.Equal(storedKey[:], se.credential.StoredKey) {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	se.done = true
+	serverSignature := hmacSHA256(se.credential.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+// scramAttributes splits a SCRAM message into its single letter attributes.
+func scramAttributes(message string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(message, ",") {
+		if len(attribute) < 2 || attribute[1] != '=' {
+			return nil, ErrScramMessage
+		}
+		attributes[attribute[:1]] = attribute[2:]
+	}
+	return attributes, nil
+}
+
+// scramUnescape decodes "=2C" and "=3D" in a SCRAM username.
+func scramUnescape(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", ErrScramMessage
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
@@ -1,20 +1,25 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"log"
 	"net"
 	"time"
 
-	"github.com/jinzhu/gorm/dialects/postgres"
-
 	"github.com/naspinall/Hive/pkg/config"
 
 	_ "github.com/joho/godotenv/autoload"
-	"github.com/naspinall/Hive-MQTT/pkg/client"
 	"github.com/naspinall/Hive-MQTT/pkg/models"
 	"github.com/naspinall/Hive-MQTT/pkg/packets"
+	"github.com/naspinall/Hive-MQTT/pkg/topics"
+)
+
+var (
+	ErrTopicNameInvalid = errors.New("Topic name invalid")
+	// Refuses a client without a ClientID whose session couldn't be resumed.
+	ErrEmptyClientID = errors.New("Empty ClientID without a clean session")
 )
 
 func NewMQTTBroker() MQTT {
@@ -25,6 +30,10 @@ func NewMQTTBroker() MQTT {
 		models.WithRetain(),
 		models.WithSession(),
 		models.WithWill(),
+		models.WithSubscription(),
+		models.WithMessage(),
+		models.WithScram(),
+		models.WithUsers(),
 	)
 	if err != nil {
 		log.Fatal(err)
@@ -35,14 +44,31 @@ func NewMQTTBroker() MQTT {
 		log.Fatal(err)
 	}
 
-	return MQTT{
-		// Default Auth handler
-		AuthHandler: func(b []byte) (bool, error) {
-			return true, nil
-		},
-		Subscriptions: make(map[string][]*Connection),
-		Services:      *services,
+	mqtt := MQTT{
+		Subscriptions:  NewSubscriptionRegistry(),
+		Sessions:       NewSessionStore(),
+		Connections:    NewConnectionRegistry(),
+		ConnectTimeout: DefaultConnectTimeout,
+		WriteTimeout:   DefaultWriteTimeout,
+		MaxPacketSize:  DefaultMaxPacketSize,
+		wills:          newPendingWills(),
+		MaxInflight:    DefaultMaxInflight,
+		MaxQueued:      DefaultMaxQueued,
+		Services:       *services,
+
+		SessionExpiryInterval: DefaultSessionExpiryInterval,
+		ReapInterval:          DefaultReapInterval,
+	}
+
+	mqtt.AddAuthMechanism(NewScramSHA256(services.ScramService))
+
+	// Picking up persistent sessions from before the broker restarted.
+	err = mqtt.RestoreSessions()
+	if err != nil {
+		log.Fatal(err)
 	}
+
+	return mqtt
 }
 
 type PublishHandler func(*packets.PublishPacket)
@@ -50,8 +76,33 @@ type SubscribeHandler func(*packets.SubscribePacket, *Connection)
 
 type MQTT struct {
 	models.Services
-	Subscriptions map[string][]*Connection
-	AuthHandler   func(b []byte) (bool, error)
+	Subscriptions *SubscriptionRegistry
+	Sessions      *SessionStore
+	Connections   *ConnectionRegistry
+	// Checks clients' credentials, nil allows every client.
+	Authenticator Authenticator
+	// Checks which topics clients may use, nil allows every topic.
+	Authorizer Authorizer
+	// MQTT 5 enhanced authentication methods by name.
+	AuthMechanisms map[string]AuthMechanism
+	wills          *pendingWills
+
+	// Maximum unacknowledged outbound QoS 1 and 2 messages per session.
+	MaxInflight int
+	// Maximum messages queued per session, zero is unlimited.
+	MaxQueued int
+	// Seconds pre MQTT 5 persistent sessions are kept after disconnecting.
+	SessionExpiryInterval uint32
+	// How often expired sessions are removed.
+	ReapInterval time.Duration
+	// How long a new connection has to send CONNECT, zero waits forever.
+	ConnectTimeout time.Duration
+	// How long a write to a client can take before its connection is closed, zero waits forever.
+	WriteTimeout time.Duration
+	// Keep alive imposed on MQTT 5 clients, zero uses the client's own.
+	ServerKeepAlive uint16
+	// Largest packet accepted from a client in bytes, zero only applies the protocol limit.
+	MaxPacketSize int
 }
 
 func (mqtt *MQTT) Listen(host string, port string) {
@@ -61,6 +112,11 @@ func (mqtt *MQTT) Listen(host string, port string) {
 		log.Fatal(err)
 	}
 	defer l.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go mqtt.ReapExpiredSessions(mqtt.ReapInterval, done)
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -71,214 +127,484 @@ func (mqtt *MQTT) Listen(host string, port string) {
 }
 
 func (mqtt *MQTT) HandlePublish(pp *packets.PublishPacket) error {
+	_, err := mqtt.publish(pp)
+	return err
+}
+
+// publishFrom delivers a client's message if it may publish to the topic.
+func (mqtt *MQTT) publishFrom(pp *packets.PublishPacket, c *Connection) (int, error) {
+	// Invalid topic names are left to publish to report.
+	if topics.ValidName(pp.TopicName) {
+		if err := mqtt.authorize(c, PublishAction, pp.TopicName); err != nil {
+			return 0, err
+		}
+	}
+	return mqtt.publish(pp)
+}
 
-	sessions, ok := mqtt.Subscriptions[pp.TopicName]
+// publish delivers a message to every matching subscription, returning how many matched.
+func (mqtt *MQTT) publish(pp *packets.PublishPacket) (int, error) {
+	if !topics.ValidName(pp.TopicName) {
+		return 0, ErrTopicNameInvalid
+	}
 
-	if ok {
-		for _, session := range sessions {
-			fmt.Printf("Sending for topic %s", pp.TopicName)
-			err := client.Publish(pp, session.Conn)
-			// One error shouldn't break all of the publishes.
-			if err != nil {
-				log.Println(err)
-			}
+	if pp.Flags.Retain {
+		if err := mqtt.HandleRetain(pp); err != nil {
+			// Current subscribers should still get the message.
+			log.Println(err)
 		}
 	}
-	return nil
+
+	subscriptions := mqtt.Subscriptions.Match(pp.TopicName)
+	dropped := 0
+	for _, subscription := range subscriptions {
+		// Messages are delivered at the lower of the published and granted QoS.
+		qos := pp.Flags.QoS
+		if subscription.QoS < qos {
+			qos = subscription.QoS
+		}
+
+		// Retain flag is only set when delivering retained messages to new subscriptions.
+		err := mqtt.Deliver(subscription.Session, pp.TopicName, pp.Payload, qos, false)
+		// One error shouldn't break all of the publishes.
+		if err == ErrQueueFull {
+			log.Printf("Queue for %s full, message to %s dropped", subscription.Session.ClientID, pp.TopicName)
+			dropped++
+		} else if err != nil {
+			log.Println(err)
+		}
+	}
+	// The publisher is only told when no subscriber had room for the message.
+	if dropped > 0 && dropped == len(subscriptions) {
+		return len(subscriptions), ErrQueueFull
+	}
+	return len(subscriptions), nil
+}
+
+// Deliver sends a message to a client at the given QoS. QoS 1 and 2
+// messages for an offline persistent session are queued until it reconnects.
+func (mqtt *MQTT) Deliver(s *Session, topic string, payload []byte, qos byte, retain bool) error {
+	op := packets.Publish(topic, payload, packets.FixedHeaderFlags{QoS: qos, Retain: retain}, 0)
+
+	c := s.Connection()
+	if c == nil {
+		if qos == 0 || !s.Persistent() {
+			return nil
+		}
+		return mqtt.QueueOffline(s, op)
+	}
+
+	if qos > 0 {
+		// Each subscriber's session allocates its own packet identifier.
+		send, err := s.Send(op)
+		if err != nil {
+			return err
+		}
+		// Inflight window is full, the message is queued on the session.
+		if !send {
+			return nil
+		}
+	} else if s.Held() {
+		// The client hasn't been sent its CONNACK yet, QoS 0 isn't queued.
+		return nil
+	}
+	return c.WritePacket(op)
 }
 
-func (mqtt *MQTT) HandleSubscribe(pp *packets.SubscribePacket, c *Connection) {
+func (mqtt *MQTT) HandleSubscribe(sp *packets.SubscribePacket, c *Connection) {
 
-	for _, topic := range pp.Topics {
-		// If subscription alreay exists we'll add to the curernt list of connections
-		current, ok := mqtt.Subscriptions[topic.Topic]
-		if ok {
-			current = append(current, c)
+	returnCodes := make([]byte, 0, len(sp.Topics))
+	var subscribed []packets.Topic
+	for _, topic := range sp.Topics {
+		if !topics.ValidFilter(topic.Topic) {
+			returnCodes = append(returnCodes, packets.TopicFilterInvalid)
 			continue
 		}
-		fmt.Printf("%+v", mqtt.Subscriptions[topic.Topic])
-		mqtt.Subscriptions[topic.Topic] = []*Connection{c}
+		if err := mqtt.authorize(c, SubscribeAction, topic.Topic); err != nil {
+			log.Printf("%s not authorised to subscribe to %s", c.ClientID, topic.Topic)
+			returnCodes = append(returnCodes, packets.NotAuthorized)
+			continue
+		}
+		mqtt.Subscriptions.Subscribe(&Subscription{
+			Session: c.Session,
+			Filter:  topic.Topic,
+			QoS:     topic.QoS,
+		})
+		if c.Session.Persistent() {
+			err := mqtt.SubscriptionService.Create(&models.Subscription{
+				ClientID: c.ClientID,
+				Filter:   topic.Topic,
+				QoS:      topic.QoS,
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		returnCodes = append(returnCodes, topic.QoS)
+		subscribed = append(subscribed, topic)
+	}
+
+	sa := packets.SubAck(sp.PacketIdentifier.PacketIdentifier, returnCodes)
+	sa.Properties = c.ReasonProperties(firstFailure(returnCodes))
+	err := c.WritePacket(sa)
+	if err != nil {
+		log.Println(err)
+		return
 	}
 
-	client.SubAck(pp.PacketIdentifier.PacketIdentifier, 0, c.Conn)
+	// Retained messages follow the SUBACK.
+	for _, topic := range subscribed {
+		if err := mqtt.SendRetained(c, topic.Topic, topic.QoS); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 func (mqtt *MQTT) HandleNewConn(conn net.Conn) {
-	p, err := packets.FromReader(conn)
+	// Connections that never send CONNECT are dropped.
+	if mqtt.ConnectTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(mqtt.ConnectTimeout)); err != nil {
+			log.Println(err)
+			conn.Close()
+			return
+		}
+	}
+
+	p, err := packets.ReadPacket(conn, mqtt.MaxPacketSize)
 	if err != nil {
 		log.Println(err)
 		conn.Close()
 		return
 	}
 
-	clientID, err := mqtt.InitSessionState(p)
+	cp, err := connectPacket(p)
+	if err == packets.ErrUnsupportedProtocol {
+		// Rejected in the 3.1.1 layout, which clients of every version can read.
+		if b, err := packets.BadProtocolVersion().Encode(); err == nil {
+			conn.Write(b)
+		}
+	}
 	if err != nil {
 		log.Println(err)
 		conn.Close()
 		return
 	}
 
+	assigned, err := assignClientID(cp)
 	c := &Connection{
-		ClientID: clientID,
-		Conn:     conn,
+		ClientID:        cp.ClientID,
+		ProtocolVersion: cp.ProtocolVersion,
+		KeepAlive:       mqtt.KeepAlive(cp),
+		Conn:            conn,
+		WriteTimeout:    mqtt.WriteTimeout,
+
+		NoProblemInformation: !cp.RequestProblemInformation,
+	}
+	if cp.UsernameFlag {
+		c.Username = cp.Username
 	}
 
-	// Sending accepted response
-	cb, err := packets.Accepted().Encode()
-	log.Println("Sending Accept")
+	// Clients are authenticated before anything is stored for them.
+	var authData []byte
+	if err == nil {
+		authData, err = mqtt.EnhancedAuth(cp, c)
+	}
+	if err == nil {
+		if c.AuthMethod == "" {
+			err = mqtt.Authenticate(cp, c)
+		} else {
+			err = mqtt.Identify(c)
+		}
+	}
+	if err == nil {
+		err = mqtt.AuthorizeWill(cp, c)
+	}
+	if err == nil {
+		err = mqtt.InitSessionState(cp, c.Username)
+	}
 	if err != nil {
-		log.Println("Cannot encode Accepted packet")
+		log.Println(err)
+		if ce, ok := err.(*ConnackError); ok {
+			refused := packets.Refused(ce.ReturnCode)
+			c.WritePacket(&refused)
+		}
 		conn.Close()
 		return
 	}
-	_, err = c.Conn.Write(cb)
+
+	previous := mqtt.Connections.Register(c)
+
+	session, sessionPresent := mqtt.ResumeSession(cp)
+	c.Session = session
+	// Nothing is sent on the connection until it has been accepted.
+	session.Hold(c)
+
+	// The session has moved to this connection, disconnecting the one it was taken from.
+	if previous != nil {
+		mqtt.TakeOver(previous, sessionPresent)
+	}
+
+	if cp.WillFlag {
+		c.Will = NewWill(cp)
+	}
+	// Reconnecting before the will delay interval has passed stops the will.
+	mqtt.CancelWill(cp.ClientID)
+
+	// Sending accepted response
+	ca := packets.Accepted(sessionPresent)
+	// MQTT 5 clients are told when the server has overridden their keep alive.
+	if c.KeepAlive != cp.KeepAlive {
+		ca.Properties.Add(packets.ServerKeepAliveIdentifier, c.KeepAlive)
+	}
+	if assigned {
+		ca.Properties.Add(packets.AssignedClientIdentifierIdentifier, c.ClientID)
+	}
+	// MQTT 5 clients are told not to send packets the server would refuse.
+	if mqtt.MaxPacketSize > 0 {
+		ca.Properties.Add(packets.MaximumPacketSizeIdentifier, uint32(mqtt.MaxPacketSize))
+	}
+	if c.AuthMethod != "" {
+		ca.Properties.Add(packets.AuthenticationMethodIdentifier, c.AuthMethod)
+		if authData != nil {
+			ca.Properties.Add(packets.AuthenticationDataIdentifier, authData)
+		}
+	}
+	log.Println("Sending Accept")
+	if err := c.WritePacket(&ca); err != nil {
+		log.Println(err)
+		mqtt.CloseConnection(c)
+		return
+	}
+
+	// Resending anything the client hadn't acknowledged before it reconnected,
+	// then whatever was queued for it while connecting.
+	err = mqtt.Retransmit(c)
+	if err == nil {
+		session.Attach(c)
+		err = mqtt.SendPending(c)
+	}
 	if err != nil {
 		log.Println(err)
-		conn.Close()
+		mqtt.CloseConnection(c)
 		return
 	}
 
+	c.DisconnectAtExpiry()
+
 	// Handling the connection
 	go mqtt.HandleConnection(c)
 }
 
-func (mqtt *MQTT) InitSessionState(p *packets.Packet) (string, error) {
+// connectPacket decodes the first packet of a connection, which must be CONNECT.
+func connectPacket(p *packets.Packet) (*packets.ConnectPacket, error) {
 	// Checking if first packet sent is a connect packet
 	if p.Type != packets.CONNECT {
 		log.Println("Inital packet is not a connect packet")
-		return "", errors.New("Bad error")
+		return nil, errors.New("Bad error")
 	}
+	return packets.NewConnectPacket(p)
+}
 
-	cp, err := packets.NewConnectPacket(p)
-	if err != nil {
-		return "", err
+// assignClientID gives a client that connected without a ClientID a unique
+// one, reporting whether it did. Before MQTT 5 the client isn't told its
+// ClientID, so only clients starting a clean session can be given one.
+func assignClientID(cp *packets.ConnectPacket) (bool, error) {
+	if cp.ClientID != "" {
+		return false, nil
 	}
-	var username string
-	if cp.UsernameFlag {
-		username = cp.Username
+	if cp.ProtocolVersion < packets.MQTT5 && !cp.CleanStartFlag {
+		return false, &ConnackError{ReturnCode: packets.IdentifierRejected, Err: ErrEmptyClientID}
 	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return false, err
+	}
+	cp.ClientID = "auto-" + hex.EncodeToString(b)
+	return true, nil
+}
 
-	// Adding session.
-	err = mqtt.SessionService.Create(&models.Session{
-		ClientID:    cp.ClientID,
-		LastConnect: time.Now(),
-		Username:    username,
+// InitSessionState stores the session of an authenticated client. Wills are
+// only held on the connection, nothing could restore them after a restart.
+func (mqtt *MQTT) InitSessionState(cp *packets.ConnectPacket, username string) error {
+	// Adding or replacing the session, it doesn't expire while connected.
+	return mqtt.SessionService.Create(&models.Session{
+		ClientID:       cp.ClientID,
+		LastConnect:    time.Now(),
+		Username:       username,
+		ExpiryInterval: mqtt.SessionExpiry(cp),
 	})
+}
 
-	if cp.WillFlag {
-		err := mqtt.WillService.Create(
-			&models.Will{
-				ClientID: cp.ClientID,
-				QoS:      cp.WillQoSFlag,
-				Message:  &postgres.Jsonb{cp.WillPayload},
-				Topic:    cp.WillTopic,
-			},
-		)
-		if err != nil {
-			return "", err
+func (mqtt *MQTT) HandleUnsubscribe(up *packets.UnsubscribePacket, c *Connection) {
+
+	reasonCodes := make([]byte, 0, len(up.Topics))
+	for _, filter := range up.Topics {
+		if !topics.ValidFilter(filter) {
+			reasonCodes = append(reasonCodes, packets.UnsubscribeTopicFilterInvalid)
+			continue
 		}
+		if !mqtt.Subscriptions.Unsubscribe(c.ClientID, filter) {
+			reasonCodes = append(reasonCodes, packets.NoSubscriptionExisted)
+			continue
+		}
+		if c.Session.Persistent() {
+			if err := mqtt.SubscriptionService.Delete(c.ClientID, filter); err != nil {
+				log.Println(err)
+			}
+		}
+		reasonCodes = append(reasonCodes, packets.UnsubscribeSuccess)
+	}
+
+	ua := packets.UnsubAck(up.PacketIdentifier.PacketIdentifier, reasonCodes)
+	ua.Properties = c.ReasonProperties(firstFailure(reasonCodes))
+	err := c.WritePacket(ua)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// firstFailure returns the first failed reason code, or success if none failed.
+func firstFailure(rcs []byte) byte {
+	for _, rc := range rcs {
+		if packets.Failed(rc) {
+			return rc
+		}
+	}
+	return packets.Success
+}
+
+// TakeOver disconnects a connection whose ClientID has been used by a new
+// connection. Its will is dropped if the session carries on.
+func (mqtt *MQTT) TakeOver(c *Connection, sessionContinues bool) {
+	log.Printf("Session for %s taken over", c.ClientID)
+	if sessionContinues {
+		c.TakeWill()
 	}
+	// Its HandleConnection finishes tearing it down once the read fails.
+	c.Disconnect(packets.Disconnect(packets.SessionTakenOver))
+}
 
-	return cp.ClientID, nil
+// CloseConnection closes the client's socket and releases everything the
+// broker holds for the connection. The will is published unless the client
+// disconnected normally.
+func (mqtt *MQTT) CloseConnection(c *Connection) {
+	c.Close()
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	// Only the session's current connection can end it, a connection that
+	// has been taken over leaves the session to its replacement.
+	if mqtt.Connections.Remove(c) && c.Session.Detach(c) {
+		if err := mqtt.DetachSession(c.Session); err != nil {
+			log.Println(err)
+		}
+	}
+	mqtt.PublishWill(c)
 }
 
 func (mqtt *MQTT) HandleConnection(c *Connection) {
+	defer mqtt.CloseConnection(c)
 	for {
-		p, err := packets.FromReader(c.Conn)
+		// Reads fail once the keep alive has passed without a packet, ending the connection.
+		if err := c.ExtendDeadline(); err != nil {
+			log.Println(err)
+			return
+		}
+		p, err := packets.ReadPacket(c.Conn, mqtt.MaxPacketSize)
 		if err != nil {
-			fmt.Println("Bad packet read")
-			c.Conn.Close()
+			log.Println(err)
+			if rc, ok := readReasonCode(err); ok {
+				c.Disconnect(packets.Disconnect(rc))
+			}
 			return
 		}
+		// Packets are decoded in the protocol version the client connected with.
+		p.Version = c.ProtocolVersion
 
-		switch p.Type {
-		case packets.PUBLISH:
-			pp, err := packets.NewPublishPacket(p)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			mqtt.HandlePublish(pp)
-			switch pp.Flags.QoS {
-			case 1:
-				b, err := packets.Acknowledge(pp.PacketIdentifier).Encode()
-				if err != nil {
-					log.Println("Back Ack packet encoding")
-					break
-				}
-				c.Conn.Write(b)
-			case 2:
-				b, err := packets.Received(pp.PacketIdentifier).Encode()
-				if err != nil {
-					log.Println("Back Ack packet encoding")
-					break
-				}
-				c.Conn.Write(b)
-				rc := make(chan uint16)
-				timeOut := time.NewTimer(500 * time.Microsecond)
-
-				select {
-				case pi := <-rc:
-					b, err := packets.Complete(pi).Encode()
-					if err != nil {
-						log.Println("Back Ack packet encoding")
-					}
-					c.Conn.Write(b)
-				case <-timeOut.C:
-					fmt.Println("Timed out")
-					continue
-				}
+		err = mqtt.HandlePacket(p, c)
+		if err == errClientDisconnected {
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			// MQTT 5 clients are told why they're being disconnected.
+			if de, ok := err.(*DisconnectError); ok {
+				c.Disconnect(packets.Disconnect(de.ReasonCode))
 			}
+			return
+		}
+	}
+}
 
-		case packets.SUBSCRIBE:
-			sp, err := packets.NewSubscribePacket(p)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			fmt.Println("Subsribe me!")
-			mqtt.HandleSubscribe(sp, c)
-		case packets.UNSUBSCRIBE:
-			continue
-		case packets.PINGREQ:
-			log.Println("<-- PING")
-			pr, err := packets.PingResponse().Encode()
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			c.Conn.Write(pr)
-			log.Println("PONG -->")
-		case packets.DISCONNECT:
-			// Removing the session from the database, disconnecting.
-			c.Conn.Close()
-			break
+// HandlePacket decodes and handles a single packet from the client. Errors
+// end the connection, a *DisconnectError says what to tell the client.
+func (mqtt *MQTT) HandlePacket(p *packets.Packet, c *Connection) error {
+	switch p.Type {
+	case packets.PUBLISH:
+		pp, err := packets.NewPublishPacket(p)
+		if err != nil {
+			return malformed(err)
+		}
+		err = mqtt.ReceivePublish(pp, c)
+		// Publishes that can't be acknowledged with a reason end the connection.
+		if err == ErrTopicNameInvalid {
+			return &DisconnectError{ReasonCode: packets.TopicNameInvalid, Err: err}
+		}
+		return err
+	case packets.PUBACK, packets.PUBREC, packets.PUBREL, packets.PUBCOMP:
+		pq, err := packets.NewPublishQoSPacket(p)
+		if err != nil {
+			return malformed(err)
+		}
+		switch p.Type {
+		case packets.PUBACK:
+			return mqtt.HandlePubAck(pq, c)
+		case packets.PUBREC:
+			return mqtt.HandlePubRec(pq, c)
+		case packets.PUBREL:
+			return mqtt.HandlePubRel(pq, c)
 		default:
-			continue
+			return mqtt.HandlePubComp(pq, c)
+		}
+	case packets.SUBSCRIBE:
+		sp, err := packets.NewSubscribePacket(p)
+		if err != nil {
+			return malformed(err)
 		}
+		mqtt.HandleSubscribe(sp, c)
+	case packets.UNSUBSCRIBE:
+		up, err := packets.NewUnsubscribePacket(p)
+		if err != nil {
+			return malformed(err)
+		}
+		mqtt.HandleUnsubscribe(up, c)
+	case packets.PINGREQ:
+		log.Println("<-- PING")
+		if err := c.WritePacket(packets.PingResponse()); err != nil {
+			return err
+		}
+		log.Println("PONG -->")
+	case packets.DISCONNECT:
+		dp, err := packets.NewDisconnectPacket(p)
+		if err != nil {
+			return malformed(err)
+		}
+		if err := mqtt.HandleDisconnect(dp, c); err != nil {
+			return err
+		}
+		return errClientDisconnected
+	case packets.AUTH:
+		ap, err := packets.NewAuthPacket(p)
+		if err != nil {
+			return malformed(err)
+		}
+		return mqtt.HandleAuth(ap, c)
+	case packets.CONNECT:
+		return &DisconnectError{ReasonCode: packets.ProtocolError, Err: errors.New("Second CONNECT on connection")}
 	}
+	return nil
 }
 
-// func (c *Connection) PublishQos(rc chan uint16) {
-// 	b := make([]byte, 4)
-// 	for {
-// 		_, err := c.Conn.Read(b)
-// 		if err != nil {
-// 			log.Println("Connection read error")
-// 			return
-// 		}
-// 		fh, err := packets.NewFixedHeader(b)
-// 		if fh.Type == 6 {
-// 			pr, err := packets.NewPublishQoSPacket(fh, b)
-// 			if err != nil {
-// 				log.Println("Bad publish QoS Packet Provided")
-// 			}
-// 			rc <- pr.PacketIdentifier.PacketIdentifier
-// 		}
-// 	}
-// }
-
 // TODO
 // Improve Networking
 // Use Context API for connections
-// Work on retain for multiplexing to other subscribers
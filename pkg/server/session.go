@@ -0,0 +1,399 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+type outboundState byte
+
+const (
+	awaitingPubAck  outboundState = iota // QoS 1 PUBLISH sent
+	awaitingPubRec                       // QoS 2 PUBLISH sent
+	awaitingPubComp                      // QoS 2 PUBREL sent
+)
+
+const (
+	DefaultMaxInflight = 20   // Unacknowledged outbound QoS 1 and 2 messages per session
+	DefaultMaxQueued   = 1000 // Messages queued per session waiting to be sent
+)
+
+var (
+	ErrNoPacketIdentifiers = errors.New("No packet identifiers available")
+	ErrQueueFull           = errors.New("Message queue full")
+)
+
+type outboundMessage struct {
+	publish *packets.PublishPacket
+	state   outboundState
+	// Order the message was sent in, retransmissions must keep this order.
+	sequence uint64
+}
+
+// Session holds the per client protocol state needed to complete
+// acknowledgement flows that span several packets. A session outlives the
+// connection it was created on so unacknowledged messages can be resent.
+type Session struct {
+	ClientID string
+	// Most messages queued waiting to be sent, zero is unlimited. Messages
+	// beyond it are dropped.
+	MaxQueued int
+
+	mu sync.Mutex
+
+	// Persistent sessions keep their subscriptions and queue messages while
+	// the client is offline, otherwise the session ends with its connection.
+	persistent bool
+	// Seconds the session is kept after its client disconnects.
+	expiry uint32
+
+	// Connection the client is currently using, nil while offline.
+	conn *Connection
+	// Set while the connection is waiting for its CONNACK and
+	// retransmissions, messages are queued until it's attached.
+	held bool
+
+	// Inbound QoS 2 packet identifiers that have been delivered and
+	// PUBRECed, but not yet released by the client.
+	received map[uint16]struct{}
+
+	// Outbound QoS 1 and 2 messages that haven't been acknowledged by the client.
+	outbound map[uint16]*outboundMessage
+
+	// Outbound messages waiting for room in the inflight window.
+	pending []*packets.PublishPacket
+
+	// Maximum size of the inflight window, zero is unlimited.
+	maxInflight int
+
+	// Last packet identifier allocated to an outbound message.
+	lastPacketIdentifier uint16
+	sequence             uint64
+}
+
+func NewSession(clientID string, maxInflight int) *Session {
+	return &Session{
+		ClientID:    clientID,
+		received:    make(map[uint16]struct{}),
+		outbound:    make(map[uint16]*outboundMessage),
+		maxInflight: maxInflight,
+	}
+}
+
+// Persistent reports whether the session is kept after its client disconnects.
+func (s *Session) Persistent() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persistent
+}
+
+// Expiry returns the seconds the session is kept after its client disconnects.
+func (s *Session) Expiry() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiry
+}
+
+// SetExpiry changes how long the session is kept after its client
+// disconnects, a zero interval ends it with its connection. It returns
+// whether the session was persistent before.
+func (s *Session) SetExpiry(expiry uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	was := s.persistent
+	s.expiry = expiry
+	s.persistent = expiry > 0
+	return was
+}
+
+// Attach makes c the connection the session's messages are sent on.
+func (s *Session) Attach(c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = c
+	s.held = false
+}
+
+// Hold moves the session to c without sending anything on it, new messages
+// are queued until Attach so nothing is written before the CONNACK.
+func (s *Session) Hold(c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = c
+	s.held = true
+}
+
+// Held reports whether the session's connection is still being set up.
+func (s *Session) Held() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held
+}
+
+// Detach marks the session offline if c is its current connection,
+// returning false if the session has already moved to another connection.
+func (s *Session) Detach(c *Connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != c {
+		return false
+	}
+	s.conn = nil
+	s.held = false
+	return true
+}
+
+// Connection returns the client's current connection, nil while offline.
+func (s *Session) Connection() *Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// Receive records an inbound QoS 2 packet identifier, returning false if it
+// is already awaiting release and so the message must not be delivered again.
+func (s *Session) Receive(pi uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.received[pi]; ok {
+		return false
+	}
+	s.received[pi] = struct{}{}
+	return true
+}
+
+// Release discards an inbound QoS 2 packet identifier once the client has
+// sent PUBREL, returning false if it was unknown.
+func (s *Session) Release(pi uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.received[pi]; !ok {
+		return false
+	}
+	delete(s.received, pi)
+	return true
+}
+
+// nextPacketIdentifier allocates the next packet identifier that isn't in
+// use by an unacknowledged outbound message. Must be called with s.mu held.
+func (s *Session) nextPacketIdentifier() (uint16, error) {
+	pi := s.lastPacketIdentifier
+	for i := 0; i < 65535; i++ {
+		pi++
+		// Zero is not a valid packet identifier.
+		if pi == 0 {
+			pi = 1
+		}
+		if _, ok := s.outbound[pi]; !ok {
+			s.lastPacketIdentifier = pi
+			return pi, nil
+		}
+	}
+	return 0, ErrNoPacketIdentifiers
+}
+
+// inflightFull reports whether the inflight window has no room. Must be called with s.mu held.
+func (s *Session) inflightFull() bool {
+	return s.maxInflight > 0 && len(s.outbound) >= s.maxInflight
+}
+
+// track allocates a packet identifier and records the message as inflight.
+// Must be called with s.mu held.
+func (s *Session) track(pp *packets.PublishPacket) error {
+	pi, err := s.nextPacketIdentifier()
+	if err != nil {
+		return err
+	}
+	pp.PacketIdentifier = pi
+
+	state := awaitingPubAck
+	if pp.Flags.QoS == 2 {
+		state = awaitingPubRec
+	}
+	s.sequence++
+	s.outbound[pi] = &outboundMessage{
+		publish:  pp,
+		state:    state,
+		sequence: s.sequence,
+	}
+	return nil
+}
+
+// Send allocates a packet identifier for an outbound QoS 1 or 2 PUBLISH and
+// records it as inflight, returning true if it should be written now. When
+// the inflight window is full, or the connection is held, the message is
+// queued until Next releases it, or dropped with ErrQueueFull if the queue
+// is full too.
+func (s *Session) Send(pp *packets.PublishPacket) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Queued messages go first so delivery order is kept.
+	if s.held || s.inflightFull() || len(s.pending) > 0 {
+		return false, s.queue(pp)
+	}
+	if err := s.track(pp); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Queue adds a message to the back of the queue without sending it, the
+// packet identifier is allocated when it's released by Next. The message is
+// dropped with ErrQueueFull if MaxQueued messages are already waiting.
+func (s *Session) Queue(pp *packets.PublishPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue(pp)
+}
+
+func (s *Session) queue(pp *packets.PublishPacket) error {
+	if s.MaxQueued > 0 && len(s.pending) >= s.MaxQueued {
+		return ErrQueueFull
+	}
+	s.pending = append(s.pending, pp)
+	return nil
+}
+
+// Next moves the oldest queued message into the inflight window if there
+// is room, returning nil if there is nothing to send.
+func (s *Session) Next() (*packets.PublishPacket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 || s.inflightFull() {
+		return nil, nil
+	}
+	pp := s.pending[0]
+	if err := s.track(pp); err != nil {
+		return nil, err
+	}
+	s.pending[0] = nil
+	s.pending = s.pending[1:]
+	return pp, nil
+}
+
+// Acknowledge discards an outbound QoS 1 message once the client has sent
+// PUBACK, returning false if it wasn't awaiting acknowledgement.
+func (s *Session) Acknowledge(pi uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.outbound[pi]
+	if !ok || m.state != awaitingPubAck {
+		return false
+	}
+	delete(s.outbound, pi)
+	return true
+}
+
+// Received moves an outbound QoS 2 message on to awaiting PUBCOMP,
+// returning false if it wasn't awaiting PUBREC.
+func (s *Session) Received(pi uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.outbound[pi]
+	if !ok || m.state == awaitingPubAck {
+		return false
+	}
+	m.state = awaitingPubComp
+	return true
+}
+
+// Complete discards an outbound QoS 2 message once the client has sent
+// PUBCOMP, returning false if it wasn't awaiting completion.
+func (s *Session) Complete(pi uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.outbound[pi]
+	if !ok || m.state != awaitingPubComp {
+		return false
+	}
+	delete(s.outbound, pi)
+	return true
+}
+
+// Discard drops an outbound message the client has rejected, returning
+// false if it wasn't inflight.
+func (s *Session) Discard(pi uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.outbound[pi]; !ok {
+		return false
+	}
+	delete(s.outbound, pi)
+	return true
+}
+
+// Inflight returns the packets needed to resume every unacknowledged
+// outbound flow, in the order they were originally sent. Messages awaiting
+// acknowledgement are resent as PUBLISH with the DUP flag set, messages
+// the client has already received are resent as PUBREL.
+func (s *Session) Inflight() []encoder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]*outboundMessage, 0, len(s.outbound))
+	for _, m := range s.outbound {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].sequence < messages[j].sequence
+	})
+
+	resend := make([]encoder, 0, len(messages))
+	for _, m := range messages {
+		pp := m.publish
+		if m.state == awaitingPubComp {
+			resend = append(resend, packets.Release(pp.PacketIdentifier))
+			continue
+		}
+		flags := pp.Flags
+		flags.Duplicate = true
+		resend = append(resend, packets.Publish(pp.TopicName, pp.Payload, flags, pp.PacketIdentifier))
+	}
+	return resend
+}
+
+// SessionStore holds the sessions of every client, connected or not, by ClientID.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Get returns the client's existing session, or false if it has none.
+func (ss *SessionStore) Get(clientID string) (*Session, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.sessions[clientID]
+	return s, ok
+}
+
+// Put stores the client's session, replacing any existing one.
+func (ss *SessionStore) Put(clientID string, s *Session) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.sessions[clientID] = s
+}
+
+// Delete discards the client's session.
+func (ss *SessionStore) Delete(clientID string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.sessions, clientID)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/naspinall/Hive-MQTT/pkg/topics"
+)
+
+// Subscription is a single client's interest in a topic filter.
+type Subscription struct {
+	Session *Session
+	Filter  string
+	QoS     byte
+}
+
+type topicNode struct {
+	children      map[string]*topicNode
+	subscriptions map[string]*Subscription // Keyed by ClientID
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:      make(map[string]*topicNode),
+		subscriptions: make(map[string]*Subscription),
+	}
+}
+
+// TopicTrie stores subscriptions one topic level per node so that
+// wildcard filters can be matched against published topic names.
+type TopicTrie struct {
+	root *topicNode
+}
+
+func NewTopicTrie() *TopicTrie {
+	return &TopicTrie{root: newTopicNode()}
+}
+
+// Insert adds the subscription under its filter, replacing any existing
+// subscription the same client holds for that filter.
+func (t *TopicTrie) Insert(s *Subscription) {
+	n := t.root
+	for _, level := range topics.Levels(s.Filter) {
+		child, ok := n.children[level]
+		if !ok {
+			child = newTopicNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.subscriptions[s.Session.ClientID] = s
+}
+
+// Remove deletes the client's subscription to filter, pruning empty nodes.
+// Returns false if there was no such subscription.
+func (t *TopicTrie) Remove(filter string, clientID string) bool {
+	return t.remove(t.root, topics.Levels(filter), clientID)
+}
+
+func (t *TopicTrie) remove(n *topicNode, levels []string, clientID string) bool {
+	if len(levels) == 0 {
+		if _, ok := n.subscriptions[clientID]; !ok {
+			return false
+		}
+		delete(n.subscriptions, clientID)
+		return true
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return false
+	}
+	removed := t.remove(child, levels[1:], clientID)
+	if len(child.children) == 0 && len(child.subscriptions) == 0 {
+		delete(n.children, levels[0])
+	}
+	return removed
+}
+
+// Match returns every subscription whose filter matches the topic name.
+// A client with several overlapping subscriptions is returned once, with
+// the highest QoS of those subscriptions.
+func (t *TopicTrie) Match(topic string) []*Subscription {
+	matched := make(map[string]*Subscription)
+	levels := topics.Levels(topic)
+	system := strings.HasPrefix(topic, topics.SystemPrefix)
+	t.match(t.root, levels, 0, system, matched)
+
+	subscriptions := make([]*Subscription, 0, len(matched))
+	for _, s := range matched {
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions
+}
+
+func (t *TopicTrie) match(n *topicNode, levels []string, depth int, system bool, matched map[string]*Subscription) {
+	// Wildcards in the first level of a filter never match $ topics.
+	wildcards := !(depth == 0 && system)
+
+	if wildcards {
+		// Multi level wildcard matches the parent level and everything below it.
+		if child, ok := n.children[topics.MultiLevel]; ok {
+			collect(child, matched)
+		}
+	}
+
+	if depth == len(levels) {
+		collect(n, matched)
+		return
+	}
+
+	if wildcards {
+		if child, ok := n.children[topics.SingleLevel]; ok {
+			t.match(child, levels, depth+1, system, matched)
+		}
+	}
+	if child, ok := n.children[levels[depth]]; ok {
+		t.match(child, levels, depth+1, system, matched)
+	}
+}
+
+func collect(n *topicNode, matched map[string]*Subscription) {
+	for clientID, s := range n.subscriptions {
+		if current, ok := matched[clientID]; ok && current.QoS >= s.QoS {
+			continue
+		}
+		matched[clientID] = s
+	}
+}
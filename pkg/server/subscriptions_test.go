@@ -0,0 +1,87 @@
+package server
+
+import (
+	"sort"
+	"testing"
+)
+
+func matchedClients(subscriptions []*Subscription) []string {
+	var clients []string
+	for _, s := range subscriptions {
+		clients = append(clients, s.Session.ClientID)
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+func TestTopicTrieMatch(t *testing.T) {
+	a := NewSession("a", 0)
+	b := NewSession("b", 0)
+	c := NewSession("c", 0)
+
+	trie := NewTopicTrie()
+	trie.Insert(&Subscription{Session: a, Filter: "site/+/telemetry/+", QoS: 0})
+	trie.Insert(&Subscription{Session: a, Filter: "site/#", QoS: 1})
+	trie.Insert(&Subscription{Session: b, Filter: "site/1/telemetry/temp", QoS: 2})
+	trie.Insert(&Subscription{Session: c, Filter: "#", QoS: 0})
+
+	tests := []struct {
+		name  string
+		topic string
+		want  []string
+	}{
+		{name: "Wildcard and exact", topic: "site/1/telemetry/temp", want: []string{"a", "b", "c"}},
+		{name: "Wildcard only", topic: "site/2/telemetry/humidity", want: []string{"a", "c"}},
+		{name: "Multi level parent", topic: "site", want: []string{"a", "c"}},
+		{name: "System topic", topic: "$SYS/uptime", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchedClients(trie.Match(tt.topic))
+			if len(got) != len(tt.want) {
+				t.Fatalf("Match(%q) = %v, want %v", tt.topic, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Match(%q) = %v, want %v", tt.topic, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTopicTrieDeduplicatesByHighestQoS(t *testing.T) {
+	a := NewSession("a", 0)
+
+	trie := NewTopicTrie()
+	trie.Insert(&Subscription{Session: a, Filter: "site/+/telemetry/+", QoS: 0})
+	trie.Insert(&Subscription{Session: a, Filter: "site/#", QoS: 2})
+
+	got := trie.Match("site/1/telemetry/temp")
+	if len(got) != 1 {
+		t.Fatalf("Match() returned %d subscriptions, want 1", len(got))
+	}
+	if got[0].QoS != 2 {
+		t.Errorf("Match() QoS = %d, want 2", got[0].QoS)
+	}
+}
+
+func TestTopicTrieRemove(t *testing.T) {
+	a := NewSession("a", 0)
+
+	trie := NewTopicTrie()
+	trie.Insert(&Subscription{Session: a, Filter: "site/+/telemetry", QoS: 0})
+
+	if !trie.Remove("site/+/telemetry", "a") {
+		t.Fatal("Remove() = false, want true")
+	}
+	if trie.Remove("site/+/telemetry", "a") {
+		t.Error("Remove() of missing subscription = true, want false")
+	}
+	if got := trie.Match("site/1/telemetry"); len(got) != 0 {
+		t.Errorf("Match() after Remove() = %d subscriptions, want 0", len(got))
+	}
+	if len(trie.root.children) != 0 {
+		t.Errorf("Remove() left %d empty nodes", len(trie.root.children))
+	}
+}
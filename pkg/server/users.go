@@ -0,0 +1,65 @@
+package server
+
+import (
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// Users authenticates clients against stored user accounts, giving them
+// their account's ACL rules. Clients without a username or with an unknown
+// one are left to the next authenticator.
+type Users struct {
+	Service models.UserService
+}
+
+func (u Users) Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error) {
+	if !cp.UsernameFlag {
+		return nil, ErrNoDecision
+	}
+	return userIdentity(u.Service.Authenticate(cp.Username, string(cp.Password)))
+}
+
+func (u Users) Identify(username string, info *ConnectInfo) (*Identity, error) {
+	return userIdentity(u.Service.Identify(username))
+}
+
+// userIdentity gives the identity of an account, or the authenticator error for why there isn't one.
+func userIdentity(user *models.User, err error) (*Identity, error) {
+	switch {
+	case err == nil:
+	case err == models.ErrUnknownUser:
+		return nil, ErrNoDecision
+	case err == models.ErrInvalidPassword:
+		return nil, ErrBadCredentials
+	case err == models.ErrUserDisabled:
+		return nil, ErrNotAuthorised
+	default:
+		return nil, err
+	}
+
+	return &Identity{
+		Username:  user.Username,
+		Superuser: user.Superuser,
+		ACL:       userACL(user.ACL),
+	}, nil
+}
+
+// userACL converts a user's stored rules, users without any get an empty
+// ACL so they're only allowed what the broker's Authorizer allows.
+func userACL(rules []models.UserACL) ACL {
+	acl := ACL{}
+	for _, rule := range rules {
+		var actions Action
+		if rule.Publish {
+			actions |= PublishAction
+		}
+		if rule.Subscribe {
+			actions |= SubscribeAction
+		}
+		if rule.RetainedRead {
+			actions |= RetainedReadAction
+		}
+		acl = append(acl, ACLRule{Topic: rule.Topic, Actions: actions, Deny: rule.Deny})
+	}
+	return acl
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// memoryUsers implements the UserService lookups the Users authenticator relies on.
+type memoryUsers struct {
+	models.UserService
+	users map[string]*models.User
+}
+
+func (mu memoryUsers) Authenticate(username, password string) (*models.User, error) {
+	user, ok := mu.users[username]
+	if !ok {
+		return nil, models.ErrUnknownUser
+	}
+	if ok, err := models.CheckPassword(user.PasswordHash, password); !ok || err != nil {
+		return nil, models.ErrInvalidPassword
+	}
+	if !user.Enabled {
+		return nil, models.ErrUserDisabled
+	}
+	return user, nil
+}
+
+func (mu memoryUsers) Identify(username string) (*models.User, error) {
+	user, ok := mu.users[username]
+	if !ok {
+		return nil, models.ErrUnknownUser
+	}
+	if !user.Enabled {
+		return nil, models.ErrUserDisabled
+	}
+	return user, nil
+}
+
+func TestUsersAuthenticate(t *testing.T) {
+	hash, err := models.HashPassword("secret", models.BcryptHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := Users{Service: memoryUsers{users: map[string]*models.User{
+		"alice": {Username: "alice", PasswordHash: hash, Enabled: true, ACL: []models.UserACL{
+			{Topic: "tenants/%u/#", Publish: true, Subscribe: true},
+		}},
+		"root":    {Username: "root", PasswordHash: hash, Enabled: true, Superuser: true},
+		"mallory": {Username: "mallory", PasswordHash: hash},
+	}}}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+		// Topic the client is then allowed to publish to, and one it isn't.
+		allowed string
+		denied  string
+	}{
+		{name: "user with ACL", username: "alice", password: "secret", allowed: "tenants/alice/status", denied: "tenants/bob/status"},
+		{name: "superuser", username: "root", password: "secret", allowed: "tenants/bob/status"},
+		{name: "wrong password", username: "alice", password: "guess", wantErr: ErrBadCredentials},
+		{name: "disabled", username: "mallory", password: "secret", wantErr: ErrNotAuthorised},
+		{name: "unknown user", username: "eve", password: "secret", wantErr: ErrNoDecision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt := testBroker()
+			mqtt.Authenticator = users
+			c, _ := pipeConnection("device")
+			cp := &packets.ConnectPacket{ClientID: "device", UsernameFlag: true, Username: tt.username, PasswordFlag: true, Password: []byte(tt.password)}
+
+			identity, err := users.Authenticate(cp, &ConnectInfo{})
+			if err != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if identity.Username != tt.username {
+				t.Errorf("Username = %q, want %q", identity.Username, tt.username)
+			}
+
+			if err := mqtt.Authenticate(cp, c); err != nil {
+				t.Fatal(err)
+			}
+			if err := mqtt.authorize(c, PublishAction, tt.allowed); err != nil {
+				t.Errorf("publish to %s denied: %v", tt.allowed, err)
+			}
+			if tt.denied != "" && mqtt.authorize(c, PublishAction, tt.denied) == nil {
+				t.Errorf("publish to %s allowed", tt.denied)
+			}
+		})
+	}
+}
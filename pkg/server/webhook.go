@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+const (
+	DefaultWebhookTimeout  = 5 * time.Second // How long the service has to answer
+	DefaultWebhookCacheTTL = time.Minute     // How long answers are reused
+	maxWebhookCacheEntries = 10000
+	maxWebhookResponseSize = 64 * 1024
+)
+
+// Actions sent to a webhook.
+const (
+	WebhookConnect      = "connect"
+	WebhookPublish      = "publish"
+	WebhookSubscribe    = "subscribe"
+	WebhookRetainedRead = "retained_read"
+)
+
+// Results a webhook answers with.
+const (
+	WebhookAllow  = "allow"  //The client may connect or use the topic
+	WebhookDeny   = "deny"   //The client is refused
+	WebhookIgnore = "ignore" //The decision is left to the next authenticator or authorizer
+)
+
+// WebhookRequest is the JSON body POSTed to a webhook.
+type WebhookRequest struct {
+	Action   string `json:"action"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username,omitempty"`
+	// Only sent when connecting.
+	Password string `json:"password,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+}
+
+// WebhookResponse is the JSON body a webhook answers with.
+type WebhookResponse struct {
+	Result string `json:"result"`
+	// Superusers can use every topic, only read when connecting.
+	Superuser bool `json:"superuser,omitempty"`
+}
+
+// Webhook delegates authentication and authorization to an HTTP service,
+// asking it about each CONNECT and each topic a client uses. Answers are
+// cached for CacheTTL. When the service can't be reached, or doesn't give
+// a valid answer, clients are allowed if FailOpen is set and refused
+// otherwise.
+type Webhook struct {
+	URL string
+	// Used for requests, nil uses one with Timeout.
+	Client *http.Client
+	// How long the service has to answer, zero doesn't time out.
+	Timeout time.Duration
+	// How long answers are reused, zero doesn't cache them.
+	CacheTTL time.Duration
+	FailOpen bool
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]webhookAnswer
+}
+
+type webhookAnswer struct {
+	response WebhookResponse
+	expires  time.Time
+}
+
+// NewWebhook returns a fail closed webhook with the default timeout and cache TTL.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:      url,
+		Timeout:  DefaultWebhookTimeout,
+		CacheTTL: DefaultWebhookCacheTTL,
+	}
+}
+
+func (w *Webhook) Authenticate(cp *packets.ConnectPacket, info *ConnectInfo) (*Identity, error) {
+	request := &WebhookRequest{
+		Action:   WebhookConnect,
+		ClientID: cp.ClientID,
+		Username: cp.Username,
+		Password: string(cp.Password),
+	}
+	response, err := w.ask(request)
+	if err != nil {
+		if w.FailOpen {
+			return &Identity{Username: cp.Username}, nil
+		}
+		return nil, err
+	}
+	switch response.Result {
+	case WebhookAllow:
+		return &Identity{Username: cp.Username, Superuser: response.Superuser}, nil
+	case WebhookDeny:
+		return nil, ErrNotAuthorised
+	}
+	return nil, ErrNoDecision
+}
+
+// webhookActions names actions in requests.
+var webhookActions = map[Action]string{
+	PublishAction:      WebhookPublish,
+	SubscribeAction:    WebhookSubscribe,
+	RetainedReadAction: WebhookRetainedRead,
+}
+
+func (w *Webhook) Authorize(c *Connection, action Action, topic string) error {
+	request := &WebhookRequest{
+		Action:   webhookActions[action],
+		ClientID: c.ClientID,
+		Username: c.Username,
+		Topic:    topic,
+	}
+	response, err := w.ask(request)
+	if err != nil {
+		if w.FailOpen {
+			return nil
+		}
+		return err
+	}
+	switch response.Result {
+	case WebhookAllow:
+		return nil
+	case WebhookDeny:
+		return ErrNotAuthorised
+	}
+	return ErrNoDecision
+}
+
+// ask returns the service's answer to a request, from the cache if it was
+// asked recently.
+func (w *Webhook) ask(request *WebhookRequest) (*WebhookResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	// Keyed by digest so passwords aren't kept in memory.
+	key := sha256.Sum256(body)
+	if response, ok := w.cached(key); ok {
+		return response, nil
+	}
+
+	response, err := w.post(body)
+	if err != nil {
+		return nil, fmt.Errorf("Webhook %s: %v", w.URL, err)
+	}
+	w.store(key, response)
+	return response, nil
+}
+
+func (w *Webhook) post(body []byte) (*WebhookResponse, error) {
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: w.Timeout}
+	}
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Draining the body lets the connection be reused.
+	defer io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxWebhookResponseSize))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	response := &WebhookResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponseSize)).Decode(response); err != nil {
+		return nil, err
+	}
+	switch response.Result {
+	case WebhookAllow, WebhookDeny, WebhookIgnore:
+		return response, nil
+	}
+	return nil, fmt.Errorf("Unknown result %q", response.Result)
+}
+
+func (w *Webhook) cached(key [sha256.Size]byte) (*WebhookResponse, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	answer, ok := w.cache[key]
+	if !ok || !time.Now().Before(answer.expires) {
+		return nil, false
+	}
+	response := answer.response
+	return &response, true
+}
+
+func (w *Webhook) store(key [sha256.Size]byte, response *WebhookResponse) {
+	if w.CacheTTL <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if w.cache == nil {
+		w.cache = make(map[[sha256.Size]byte]webhookAnswer)
+	}
+	// A full cache drops expired answers, then everything if that isn't enough.
+	if len(w.cache) >= maxWebhookCacheEntries {
+		for k, answer := range w.cache {
+			if !now.Before(answer.expires) {
+				delete(w.cache, k)
+			}
+		}
+		if len(w.cache) >= maxWebhookCacheEntries {
+			w.cache = make(map[[sha256.Size]byte]webhookAnswer)
+		}
+	}
+	w.cache[key] = webhookAnswer{response: *response, expires: now.Add(w.CacheTTL)}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// accountService stands in for a webhook, recording the requests it's sent.
+type accountService struct {
+	mu       sync.Mutex
+	requests []WebhookRequest
+	// Answers by username, connecting, and by topic, authorizing.
+	answers map[string]WebhookResponse
+	status  int
+	delay   time.Duration
+}
+
+func (as *accountService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	as.mu.Lock()
+	as.requests = append(as.requests, request)
+	as.mu.Unlock()
+
+	time.Sleep(as.delay)
+	if as.status != 0 {
+		w.WriteHeader(as.status)
+		return
+	}
+	key := request.Topic
+	if request.Action == WebhookConnect {
+		key = request.Username + ":" + request.Password
+	}
+	answer, ok := as.answers[key]
+	if !ok {
+		answer.Result = WebhookIgnore
+	}
+	json.NewEncoder(w).Encode(answer)
+}
+
+func (as *accountService) calls() int {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return len(as.requests)
+}
+
+func newAccountService() *accountService {
+	return &accountService{answers: map[string]WebhookResponse{
+		"app:secret":   {Result: WebhookAllow},
+		"admin:secret": {Result: WebhookAllow, Superuser: true},
+		"app:guess":    {Result: WebhookDeny},
+		"devices/app":  {Result: WebhookAllow},
+		"devices/#":    {Result: WebhookDeny},
+	}}
+}
+
+func TestWebhookAuthenticate(t *testing.T) {
+	service := newAccountService()
+	server := httptest.NewServer(service)
+	defer server.Close()
+	webhook := NewWebhook(server.URL)
+
+	tests := []struct {
+		name          string
+		username      string
+		password      string
+		wantSuperuser bool
+		wantErr       error
+	}{
+		{"allowed", "app", "secret", false, nil},
+		{"superuser", "admin", "secret", true, nil},
+		{"denied", "app", "guess", false, ErrNotAuthorised},
+		{"ignored", "other", "secret", false, ErrNoDecision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp := &packets.ConnectPacket{
+				ClientID:     "device",
+				UsernameFlag: true,
+				Username:     tt.username,
+				PasswordFlag: true,
+				Password:     []byte(tt.password),
+			}
+			identity, err := webhook.Authenticate(cp, &ConnectInfo{})
+			if err != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (identity.Username != tt.username || identity.Superuser != tt.wantSuperuser) {
+				t.Errorf("Identity = %+v", identity)
+			}
+		})
+	}
+
+	want := WebhookRequest{Action: WebhookConnect, ClientID: "device", Username: "app", Password: "secret"}
+	if service.requests[0] != want {
+		t.Errorf("request = %+v, want %+v", service.requests[0], want)
+	}
+}
+
+func TestWebhookAuthorize(t *testing.T) {
+	service := newAccountService()
+	server := httptest.NewServer(service)
+	defer server.Close()
+	webhook := NewWebhook(server.URL)
+	c := &Connection{ClientID: "device", Username: "app"}
+
+	tests := []struct {
+		name    string
+		action  Action
+		topic   string
+		wantErr error
+	}{
+		{"allowed", PublishAction, "devices/app", nil},
+		{"denied", SubscribeAction, "devices/#", ErrNotAuthorised},
+		{"ignored", RetainedReadAction, "other", ErrNoDecision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := webhook.Authorize(c, tt.action, tt.topic); err != tt.wantErr {
+				t.Fatalf("Authorize() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	want := WebhookRequest{Action: WebhookSubscribe, ClientID: "device", Username: "app", Topic: "devices/#"}
+	if service.requests[1] != want {
+		t.Errorf("request = %+v, want %+v", service.requests[1], want)
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	service := newAccountService()
+	server := httptest.NewServer(service)
+	defer server.Close()
+	webhook := NewWebhook(server.URL)
+	webhook.CacheTTL = 50 * time.Millisecond
+	c := &Connection{ClientID: "device", Username: "app"}
+
+	for i := 0; i < 3; i++ {
+		if err := webhook.Authorize(c, PublishAction, "devices/app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if service.calls() != 1 {
+		t.Fatalf("service asked %d times, want once", service.calls())
+	}
+
+	// Other clients and actions aren't answered from the cache.
+	if err := webhook.Authorize(&Connection{ClientID: "other"}, PublishAction, "devices/app"); err != nil {
+		t.Fatal(err)
+	}
+	webhook.Authorize(c, SubscribeAction, "devices/app")
+	if service.calls() != 3 {
+		t.Fatalf("service asked %d times, want 3", service.calls())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	webhook.Authorize(c, PublishAction, "devices/app")
+	if service.calls() != 4 {
+		t.Errorf("expired answer was reused")
+	}
+}
+
+func TestWebhookFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  *accountService
+		failOpen bool
+	}{
+		{"timeout fails closed", &accountService{delay: 100 * time.Millisecond}, false},
+		{"timeout fails open", &accountService{delay: 100 * time.Millisecond}, true},
+		{"server error fails closed", &accountService{status: http.StatusInternalServerError}, false},
+		{"server error fails open", &accountService{status: http.StatusInternalServerError}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.service)
+			defer server.Close()
+			webhook := NewWebhook(server.URL)
+			webhook.Timeout = 20 * time.Millisecond
+			webhook.FailOpen = tt.failOpen
+
+			cp := &packets.ConnectPacket{ClientID: "device", UsernameFlag: true, Username: "app", PasswordFlag: true, Password: []byte("secret")}
+			_, connectErr := webhook.Authenticate(cp, &ConnectInfo{})
+			authorizeErr := webhook.Authorize(&Connection{ClientID: "device"}, PublishAction, "devices/app")
+			if tt.failOpen {
+				if connectErr != nil || authorizeErr != nil {
+					t.Errorf("failing open refused the client: %v, %v", connectErr, authorizeErr)
+				}
+				return
+			}
+			if connectErr == nil || authorizeErr == nil {
+				t.Fatal("failing closed allowed the client")
+			}
+
+			// Failures aren't cached.
+			if webhook.Authorize(&Connection{ClientID: "device"}, PublishAction, "devices/app"); tt.service.calls() != 3 {
+				t.Errorf("service asked %d times, want 3", tt.service.calls())
+			}
+		})
+	}
+}
+
+func TestWebhookRefusesConnect(t *testing.T) {
+	server := httptest.NewServer(&accountService{status: http.StatusServiceUnavailable})
+	defer server.Close()
+	mqtt := &MQTT{Authenticator: NewWebhook(server.URL)}
+	c, client := pipeConnection("device")
+	defer client.Close()
+
+	cp := &packets.ConnectPacket{ClientID: "device", UsernameFlag: true, Username: "app", PasswordFlag: true, Password: []byte("secret")}
+	err := mqtt.Authenticate(cp, c)
+	ce, ok := err.(*ConnackError)
+	if !ok || ce.ReturnCode != packets.ServerUnavailable {
+		t.Errorf("Authenticate() error = %v, want server unavailable", err)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+// NewWill builds the will message from a CONNECT with the will flag set.
+func NewWill(cp *packets.ConnectPacket) *models.Will {
+	will := &models.Will{
+		ClientID: cp.ClientID,
+		QoS:      cp.WillQoSFlag,
+		Retain:   cp.WillRetainFlag,
+		Payload:  cp.WillPayload,
+		Topic:    cp.WillTopic,
+	}
+	if cp.WillProperties != nil {
+		will.DelayInterval = cp.WillProperties.WillDelayInterval
+	}
+	return will
+}
+
+// pendingWills holds the timers of wills waiting out their delay interval.
+type pendingWills struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newPendingWills() *pendingWills {
+	return &pendingWills{
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+func (pw *pendingWills) schedule(clientID string, delay time.Duration, publish func()) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if t, ok := pw.timers[clientID]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		pw.mu.Lock()
+		// A reconnect may have replaced or cancelled this timer.
+		if pw.timers[clientID] != t {
+			pw.mu.Unlock()
+			return
+		}
+		delete(pw.timers, clientID)
+		pw.mu.Unlock()
+		publish()
+	})
+	pw.timers[clientID] = t
+}
+
+// cancel stops a pending will, returning false if there wasn't one.
+func (pw *pendingWills) cancel(clientID string) bool {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	t, ok := pw.timers[clientID]
+	if !ok {
+		return false
+	}
+	t.Stop()
+	delete(pw.timers, clientID)
+	return true
+}
+
+// PublishWill publishes the will of a connection that ended without a
+// DISCONNECT, once its will delay interval has passed.
+func (mqtt *MQTT) PublishWill(c *Connection) {
+	will := c.TakeWill()
+	if will == nil {
+		return
+	}
+
+	publish := func() {
+		pp := packets.Publish(will.Topic, will.Payload, packets.FixedHeaderFlags{QoS: will.QoS, Retain: will.Retain}, 0)
+		if err := mqtt.HandlePublish(pp); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// The will is published when the session ends if that's sooner than the delay.
+	delay := will.DelayInterval
+	if c.Session != nil {
+		if expiry := c.Session.Expiry(); expiry < delay {
+			delay = expiry
+		}
+	}
+	if delay == 0 {
+		publish()
+		return
+	}
+	mqtt.wills.schedule(will.ClientID, time.Duration(delay)*time.Second, publish)
+}
+
+// DiscardWill drops a connection's will after a normal disconnect.
+func (mqtt *MQTT) DiscardWill(c *Connection) {
+	c.TakeWill()
+}
+
+// CancelWill stops a delayed will from being published when its client reconnects in time.
+func (mqtt *MQTT) CancelWill(clientID string) {
+	if mqtt.wills.cancel(clientID) {
+		log.Printf("Cancelled delayed will for %s", clientID)
+	}
+}
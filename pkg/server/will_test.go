@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naspinall/Hive-MQTT/pkg/models"
+	"github.com/naspinall/Hive-MQTT/pkg/packets"
+)
+
+func TestWillPublishedOnAbnormalClose(t *testing.T) {
+	mqtt := testBroker()
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: subscriber.Session, Filter: "presence/+"})
+
+	device, _ := pipeConnection("device")
+	device.Will = &models.Will{ClientID: "device", Topic: "presence/device", Payload: []byte("0")}
+
+	done := make(chan struct{})
+	go func() {
+		mqtt.CloseConnection(device)
+		close(done)
+	}()
+	expectBytes(t, subscriberClient, []byte{0x30, 18, 0, 15, 'p', 'r', 'e', 's', 'e', 'n', 'c', 'e', '/', 'd', 'e', 'v', 'i', 'c', 'e', '0'})
+	<-done
+}
+
+func TestWillDiscardedOnDisconnect(t *testing.T) {
+	mqtt := testBroker()
+	subscriber, subscriberClient := pipeConnection("subscriber")
+	mqtt.Subscriptions.Subscribe(&Subscription{Session: subscriber.Session, Filter: "presence/+"})
+
+	device, _ := pipeConnection("device")
+	device.Will = &models.Will{ClientID: "device", Topic: "presence/device", Payload: []byte("0")}
+
+	mqtt.DiscardWill(device)
+	done := make(chan struct{})
+	go func() {
+		mqtt.CloseConnection(device)
+		close(done)
+	}()
+	subscriberClient.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := subscriberClient.Read(make([]byte, 1)); n > 0 || err == nil {
+		t.Error("will published after DISCONNECT")
+	}
+	// Unblocks a will that was being written.
+	subscriberClient.Close()
+	<-done
+}
+
+func TestDelayedWillCancelledOnReconnect(t *testing.T) {
+	mqtt := testBroker()
+	published := make(chan struct{}, 1)
+	mqtt.wills.schedule("device", 10*time.Millisecond, func() { published <- struct{}{} })
+
+	mqtt.CancelWill("device")
+
+	select {
+	case <-published:
+		t.Fatal("will published after the client reconnected")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mqtt.wills.schedule("device", time.Millisecond, func() { published <- struct{}{} })
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("delayed will was not published")
+	}
+}
+
+func TestNewWill(t *testing.T) {
+	cp := &packets.ConnectPacket{
+		ClientID:       "device",
+		WillFlag:       true,
+		WillQoSFlag:    1,
+		WillRetainFlag: true,
+		WillTopic:      "presence/device",
+		WillPayload:    []byte("0"),
+		WillProperties: &packets.WillProperties{WillDelayInterval: 30},
+	}
+	will := NewWill(cp)
+	if will.QoS != 1 || !will.Retain || will.DelayInterval != 30 || will.Topic != "presence/device" {
+		t.Errorf("NewWill() = %+v", will)
+	}
+}
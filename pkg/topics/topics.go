@@ -0,0 +1,129 @@
+package topics
+
+import "strings"
+
+const (
+	Separator      = "/" // Topic level separator
+	SingleLevel    = "+" // Single level wildcard
+	MultiLevel     = "#" // Multi level wildcard
+	SystemPrefix   = "$" // Topics beginning with $ are not matched by leading wildcards
+	maxTopicLength = 65535
+)
+
+// Levels splits a topic name or filter into its levels.
+func Levels(topic string) []string {
+	return strings.Split(topic, Separator)
+}
+
+// ValidName reports whether topic can be used as the topic name of a PUBLISH.
+func ValidName(topic string) bool {
+	if len(topic) == 0 || len(topic) > maxTopicLength {
+		return false
+	}
+	return !strings.ContainsAny(topic, SingleLevel+MultiLevel+"\x00")
+}
+
+// ValidFilter reports whether filter is a well formed subscription topic filter.
+func ValidFilter(filter string) bool {
+	if len(filter) == 0 || len(filter) > maxTopicLength || strings.Contains(filter, "\x00") {
+		return false
+	}
+	levels := Levels(filter)
+	for i, level := range levels {
+		// Wildcards must occupy an entire level.
+		if strings.ContainsAny(level, SingleLevel+MultiLevel) && len(level) != 1 {
+			return false
+		}
+		// The multi level wildcard must be the last character of the filter.
+		if level == MultiLevel && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether the topic name is matched by the topic filter.
+func Match(filter, topic string) bool {
+	fl := Levels(filter)
+	tl := Levels(topic)
+
+	// Wildcards at the first level never match $ topics.
+	if strings.HasPrefix(topic, SystemPrefix) && (fl[0] == SingleLevel || fl[0] == MultiLevel) {
+		return false
+	}
+
+	for i, level := range fl {
+		if level == MultiLevel {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if level != SingleLevel && level != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+// Covers reports whether every topic matched by the inner filter is also
+// matched by the outer filter.
+func Covers(outer, inner string) bool {
+	ol := Levels(outer)
+	il := Levels(inner)
+
+	// Filters starting with a wildcard can't cover $ topics.
+	if isWildcard(ol[0]) && strings.HasPrefix(inner, SystemPrefix) {
+		return false
+	}
+
+	for i, level := range ol {
+		if level == MultiLevel {
+			return true
+		}
+		if i >= len(il) {
+			return false
+		}
+		switch {
+		case il[i] == MultiLevel:
+			return false
+		case level == SingleLevel:
+			continue
+		case level != il[i]:
+			return false
+		}
+	}
+	return len(ol) == len(il)
+}
+
+// Overlap reports whether any topic name is matched by both filters.
+func Overlap(a, b string) bool {
+	al := Levels(a)
+	bl := Levels(b)
+
+	// Wildcards at the first level never match $ topics.
+	if isWildcard(al[0]) && strings.HasPrefix(b, SystemPrefix) || isWildcard(bl[0]) && strings.HasPrefix(a, SystemPrefix) {
+		return false
+	}
+
+	for i := 0; i < len(al) && i < len(bl); i++ {
+		if al[i] == MultiLevel || bl[i] == MultiLevel {
+			return true
+		}
+		if al[i] != SingleLevel && bl[i] != SingleLevel && al[i] != bl[i] {
+			return false
+		}
+	}
+	// The longer filter can only carry on with a multi level wildcard, which matches the parent.
+	var rest []string
+	if len(al) > len(bl) {
+		rest = al[len(bl):]
+	} else {
+		rest = bl[len(al):]
+	}
+	return len(rest) == 0 || len(rest) == 1 && rest[0] == MultiLevel
+}
+
+func isWildcard(level string) bool {
+	return level == SingleLevel || level == MultiLevel
+}
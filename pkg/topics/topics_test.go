@@ -0,0 +1,124 @@
+package topics
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		topic  string
+		want   bool
+	}{
+		{name: "Exact match", filter: "site/1/telemetry", topic: "site/1/telemetry", want: true},
+		{name: "Exact mismatch", filter: "site/1/telemetry", topic: "site/2/telemetry", want: false},
+		{name: "Single level wildcard", filter: "site/+/telemetry/+", topic: "site/1/telemetry/temp", want: true},
+		{name: "Single level wildcard too short", filter: "site/+/telemetry/+", topic: "site/1/telemetry", want: false},
+		{name: "Single level wildcard empty level", filter: "site/+/telemetry", topic: "site//telemetry", want: true},
+		{name: "Multi level wildcard", filter: "site/#", topic: "site/1/telemetry/temp", want: true},
+		{name: "Multi level wildcard matches parent", filter: "site/#", topic: "site", want: true},
+		{name: "Multi level wildcard only", filter: "#", topic: "site/1", want: true},
+		{name: "Multi level wildcard excludes system topics", filter: "#", topic: "$SYS/broker", want: false},
+		{name: "Single level wildcard excludes system topics", filter: "+/broker", topic: "$SYS/broker", want: false},
+		{name: "Explicit system topic", filter: "$SYS/#", topic: "$SYS/broker", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Match(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{filter: "site/+/telemetry/#", want: true},
+		{filter: "#", want: true},
+		{filter: "+", want: true},
+		{filter: "", want: false},
+		{filter: "site/#/telemetry", want: false},
+		{filter: "site/tele#", want: false},
+		{filter: "site+/telemetry", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			if got := ValidFilter(tt.filter); got != tt.want {
+				t.Errorf("ValidFilter(%q) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{topic: "site/1/telemetry", want: true},
+		{topic: "", want: false},
+		{topic: "site/+", want: false},
+		{topic: "site/#", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			if got := ValidName(tt.topic); got != tt.want {
+				t.Errorf("ValidName(%q) = %v, want %v", tt.topic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		name  string
+		outer string
+		inner string
+		want  bool
+	}{
+		{name: "Same filter", outer: "site/+/telemetry", inner: "site/+/telemetry", want: true},
+		{name: "Single level covers name", outer: "site/+/telemetry", inner: "site/1/telemetry", want: true},
+		{name: "Multi level covers narrower wildcard", outer: "site/#", inner: "site/+/telemetry/#", want: true},
+		{name: "Multi level covers parent", outer: "site/#", inner: "site", want: true},
+		{name: "Name does not cover wildcard", outer: "site/1", inner: "site/+", want: false},
+		{name: "Single level does not cover multi level", outer: "site/+", inner: "site/#", want: false},
+		{name: "Narrower does not cover everything", outer: "tenants/a/#", inner: "#", want: false},
+		{name: "Different levels", outer: "site/+/telemetry", inner: "site/1/status", want: false},
+		{name: "Wildcard does not cover system topics", outer: "#", inner: "$SYS/#", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Covers(tt.outer, tt.inner); got != tt.want {
+				t.Errorf("Covers(%q, %q) = %v, want %v", tt.outer, tt.inner, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want bool
+	}{
+		{name: "Everything overlaps a tenant", a: "#", b: "tenants/a/secret", want: true},
+		{name: "Wildcards in different levels", a: "tenants/+/secret", b: "tenants/a/+", want: true},
+		{name: "Disjoint literals", a: "tenants/a/#", b: "tenants/b/#", want: false},
+		{name: "Multi level matches parent", a: "tenants/a", b: "tenants/a/#", want: true},
+		{name: "Longer filter without multi level", a: "tenants/a", b: "tenants/+/secret", want: false},
+		{name: "Wildcard does not overlap system topics", a: "$SYS/broker", b: "+/broker", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Overlap(tt.a, tt.b); got != tt.want {
+				t.Errorf("Overlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if got := Overlap(tt.b, tt.a); got != tt.want {
+				t.Errorf("Overlap(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}